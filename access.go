@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// MaxTrackedHosts bounds how many addresses reconnect tracking remembers
+// before stale entries are swept.
+const MaxTrackedHosts = 1000
+
+// ParseCIDRs parses a comma-separated list of CIDR ranges such as
+// "10.0.0.0/8,192.168.1.0/24". An empty list gives no ranges.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", field)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// permittedNetwork reports whether conn comes from a network the server
+// accepts: not in DenyCIDRs and, if AllowCIDRs is set, in one of those.
+func (s *Server) permittedNetwork(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return len(s.AllowCIDRs) == 0
+	}
+	for _, ipnet := range s.DenyCIDRs {
+		if ipnet.Contains(addr.IP) {
+			return false
+		}
+	}
+	if len(s.AllowCIDRs) == 0 {
+		return true
+	}
+	for _, ipnet := range s.AllowCIDRs {
+		if ipnet.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// throttled records a connection attempt from conn's address and reports
+// whether that address must back off: more than ReconnectLimit attempts
+// within ReconnectWindow refuse it for ReconnectCooldown. Callers hold
+// ClientsLock.
+func (s *Server) throttled(conn net.Conn, now time.Time) bool {
+	if s.ReconnectLimit <= 0 {
+		return false
+	}
+	host := remoteHost(conn)
+	if until, ok := s.penalties[host]; ok {
+		if now.Before(until) {
+			return true
+		}
+		delete(s.penalties, host)
+	}
+
+	var recent []time.Time
+	for _, t := range s.attempts[host] {
+		if now.Sub(t) < s.ReconnectWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) > s.ReconnectLimit {
+		delete(s.attempts, host)
+		s.penalties[host] = now.Add(s.ReconnectCooldown)
+		return true
+	}
+	s.attempts[host] = recent
+
+	if len(s.attempts) > MaxTrackedHosts {
+		for other, times := range s.attempts {
+			if now.Sub(times[len(times)-1]) >= s.ReconnectWindow {
+				delete(s.attempts, other)
+			}
+		}
+	}
+	return false
+}
+
+// remoteHost returns the IP address conn comes from.
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
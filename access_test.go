@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// cidrs parses list or fails the test.
+func cidrs(t *testing.T, list string) []*net.IPNet {
+	t.Helper()
+	nets, err := ParseCIDRs(list)
+	if err != nil {
+		t.Fatalf("ParseCIDRs(%q): %v", list, err)
+	}
+	return nets
+}
+
+// TestCIDRFiltering tests that -allowcidr and -denycidr decide which
+// networks may connect, and that everyone may by default.
+func TestCIDRFiltering(t *testing.T) {
+	t.Run("default allows all", func(t *testing.T) {
+		_, addr := startTestServer(t)
+		joinClient(t, addr, "Alice")
+	})
+
+	t.Run("allowed network", func(t *testing.T) {
+		_, addr := startTestServer(t, func(s *Server) {
+			s.AllowCIDRs = cidrs(t, "10.0.0.0/8, 127.0.0.0/8")
+		})
+		joinClient(t, addr, "Alice")
+	})
+
+	t.Run("not in allowed networks", func(t *testing.T) {
+		_, addr := startTestServer(t, func(s *Server) {
+			s.AllowCIDRs = cidrs(t, "10.0.0.0/8")
+		})
+		c := dialClient(t, addr)
+		c.expect("Connection not permitted from your network.")
+		c.expect("disconnected: network not permitted")
+		c.expectClosed()
+	})
+
+	t.Run("denied network", func(t *testing.T) {
+		_, addr := startTestServer(t, func(s *Server) {
+			s.AllowCIDRs = cidrs(t, "127.0.0.0/8")
+			s.DenyCIDRs = cidrs(t, "127.0.0.1/32")
+		})
+		c := dialClient(t, addr)
+		c.expect("Connection not permitted from your network.")
+		c.expect("disconnected: network not permitted")
+		c.expectClosed()
+	})
+}
+
+// TestParseCIDRsInvalid tests that a malformed range is reported.
+func TestParseCIDRsInvalid(t *testing.T) {
+	if _, err := ParseCIDRs("10.0.0.0/8,not-a-range"); err == nil {
+		t.Error("ParseCIDRs accepted an invalid range")
+	}
+}
+
+// TestReconnectBackoff tests that an address reconnecting too often is
+// refused until its cooldown has passed.
+func TestReconnectBackoff(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.ReconnectLimit = 3
+		s.ReconnectWindow = time.Minute
+		s.ReconnectCooldown = 300 * time.Millisecond
+	})
+
+	for i := 0; i < 3; i++ {
+		c := dialClient(t, addr)
+		c.expect("o_o") // the logo
+		c.conn.Close()
+	}
+	c := dialClient(t, addr)
+	c.expect("Too many reconnect attempts; slow down.")
+	c.expect("disconnected: reconnect backoff")
+	c.expectClosed()
+
+	time.Sleep(350 * time.Millisecond)
+	joinClient(t, addr, "Alice")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// AdminMode decides who administers the server.
+type AdminMode string
+
+const (
+	// AdminFirst makes the first client to join the admin. When the last
+	// admin leaves, the longest-connected client takes over.
+	AdminFirst AdminMode = "first"
+	// AdminPassword makes admins of clients that run /admin with
+	// AdminPassword.
+	AdminPassword AdminMode = "password"
+	// AdminNone disables admin commands.
+	AdminNone AdminMode = "none"
+)
+
+// ParseAdminMode converts an -adminmode value to an AdminMode.
+func ParseAdminMode(s string) (AdminMode, error) {
+	switch m := AdminMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case AdminFirst, AdminPassword, AdminNone:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown admin mode %q (want first, password or none)", s)
+}
+
+// isAdmin reports whether client is an admin.
+func (s *Server) isAdmin(client *Client) bool {
+	s.ClientsLock.Lock()
+	defer s.ClientsLock.Unlock()
+	return client.Admin
+}
+
+// claimAdmin handles /admin <password> in AdminPassword mode.
+func (s *Server) claimAdmin(client *Client, password string) {
+	if s.AdminMode != AdminPassword {
+		s.reply(client.Conn, "Admin passwords are not enabled on this server.\n")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(s.AdminPassword)) != 1 {
+		s.reply(client.Conn, "Wrong admin password.\n")
+		s.logActivity(fmt.Sprintf("Client %s gave a wrong admin password.", client.Username))
+		return
+	}
+
+	s.ClientsLock.Lock()
+	already := client.Admin
+	client.Admin = true
+	s.ClientsLock.Unlock()
+	if already {
+		s.reply(client.Conn, "You are already an admin.\n")
+		return
+	}
+	s.announceAdmin(client.Username)
+}
+
+// promoteOldest makes the longest-connected client the admin if none is
+// left, in AdminFirst mode. It returns the promoted client, if any.
+// Callers hold ClientsLock.
+func (s *Server) promoteOldest() *Client {
+	if s.AdminMode != AdminFirst || s.closed {
+		return nil
+	}
+	var oldest *Client
+	for _, client := range s.Clients {
+		if client.Admin {
+			return nil
+		}
+		if oldest == nil || client.JoinedAt.Before(oldest.JoinedAt) {
+			oldest = client
+		}
+	}
+	if oldest != nil {
+		oldest.Admin = true
+	}
+	return oldest
+}
+
+// announceAdmin tells everyone that name became an admin.
+func (s *Server) announceAdmin(name string) {
+	s.broadcast(s.Format.Info(fmt.Sprintf("%s is now an admin", name)), "")
+	s.logActivity(fmt.Sprintf("Client %s is now an admin.", name))
+}
+
+// setAdmin handles /promote <user> and /demote <user>. With KeepAdmin, the
+// last admin can't be demoted.
+func (s *Server) setAdmin(client *Client, target string, on bool) {
+	if !s.isAdmin(client) {
+		s.reply(client.Conn, "Only admins can promote or demote users.\n")
+		return
+	}
+	if target == "" {
+		if on {
+			s.reply(client.Conn, "Usage: /promote <user>\n")
+		} else {
+			s.reply(client.Conn, "Usage: /demote <user>\n")
+		}
+		return
+	}
+
+	s.ClientsLock.Lock()
+	other := s.findClient(target)
+	if other == nil {
+		s.ClientsLock.Unlock()
+		s.reply(client.Conn, fmt.Sprintf("%s is not online.\n", target))
+		return
+	}
+	name := other.Username
+	if other.Admin == on {
+		s.ClientsLock.Unlock()
+		if on {
+			s.reply(client.Conn, fmt.Sprintf("%s is already an admin.\n", name))
+		} else {
+			s.reply(client.Conn, fmt.Sprintf("%s is not an admin.\n", name))
+		}
+		return
+	}
+	if !on && s.KeepAdmin && s.adminCount() == 1 {
+		s.ClientsLock.Unlock()
+		s.reply(client.Conn, "Can't demote the last admin.\n")
+		return
+	}
+	other.Admin = on
+	s.ClientsLock.Unlock()
+
+	if on {
+		s.announceAdmin(name)
+		return
+	}
+	s.broadcast(s.Format.Info(fmt.Sprintf("%s is no longer an admin", name)), "")
+	s.logActivity(fmt.Sprintf("Client %s demoted %s.", client.Username, name))
+}
+
+// adminCount returns the number of connected admins. Callers hold
+// ClientsLock.
+func (s *Server) adminCount() int {
+	count := 0
+	for _, client := range s.Clients {
+		if client.Admin {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+// TestAdminFirst tests that the first client is admin and that the
+// longest-connected client takes over when the admin leaves.
+func TestAdminFirst(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+	carol := joinClient(t, addr, "Carol")
+
+	bob.send("/lockdown on")
+	bob.expect("Only admins can lock the chat.")
+	bob.send("/admin secret")
+	bob.expect("Admin passwords are not enabled on this server.")
+
+	admin.conn.Close()
+	carol.expect("[INFO]: Bob is now an admin")
+	bob.send("/lockdown on")
+	carol.expect("[INFO]: chat locked")
+}
+
+// TestAdminPassword tests that nobody is admin until they run /admin with
+// the right password.
+func TestAdminPassword(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.AdminMode = AdminPassword
+		s.AdminPassword = "hunter2"
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("/lockdown on")
+	alice.expect("Only admins can lock the chat.")
+	alice.send("/admin guess")
+	alice.expect("Wrong admin password.")
+	alice.send("/admin hunter2")
+	bob.expect("[INFO]: Alice is now an admin")
+	alice.send("/admin hunter2")
+	alice.expect("You are already an admin.")
+	alice.send("/lockdown on")
+	bob.expect("[INFO]: chat locked")
+
+	bob.send("/lockdown off")
+	bob.expect("Only admins can lock the chat.")
+	alice.conn.Close()
+	bob.expect("Alice left the chat")
+	bob.expectNone("is now an admin")
+}
+
+// TestAdminNone tests that no client is admin, not even the first.
+func TestAdminNone(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) { s.AdminMode = AdminNone })
+	alice := joinClient(t, addr, "Alice")
+
+	alice.send("/lockdown on")
+	alice.expect("Only admins can lock the chat.")
+	alice.send("/whoami")
+	alice.expect("admin: no")
+	alice.send("/admin anything")
+	alice.expect("Admin passwords are not enabled on this server.")
+}
+
+// TestPromoteDemote tests handing admin to another user and taking it
+// back, the last-admin guard and refusing non-admins.
+func TestPromoteDemote(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+
+	bob.send("/promote Bob")
+	bob.expect("Only admins can promote or demote users.")
+	admin.send("/demote Admin")
+	admin.expect("Can't demote the last admin.")
+	admin.send("/promote nobody")
+	admin.expect("nobody is not online.")
+
+	admin.send("/promote bob")
+	admin.expect("[INFO]: Bob is now an admin")
+	bob.expect("[INFO]: Bob is now an admin")
+	admin.send("/promote Bob")
+	admin.expect("Bob is already an admin.")
+
+	bob.send("/demote Admin")
+	admin.expect("[INFO]: Admin is no longer an admin")
+	admin.send("/lockdown on")
+	admin.expect("Only admins can lock the chat.")
+	bob.send("/demote Admin")
+	bob.expect("Admin is not an admin.")
+}
+
+// TestDemoteLastAdminAllowed tests that without KeepAdmin the last admin
+// can step down.
+func TestDemoteLastAdminAllowed(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) { s.KeepAdmin = false })
+	admin := joinClient(t, addr, "Admin")
+
+	admin.send("/demote Admin")
+	admin.expect("[INFO]: Admin is no longer an admin")
+	admin.send("/whoami")
+	admin.expect("admin: no")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// builtinCommands lists the commands handled by receiveMessagesFromClient
+// and handleCommand. Keep it in sync with them: aliases may only point at
+// these and may never replace one.
+var builtinCommands = map[string]bool{
+	"/exit": true, "/name": true, "/admin": true, "/promote": true, "/demote": true,
+	"/unname": true, "/stats": true, "/slowmode": true, "/shout": true, "/poll": true,
+	"/vote": true, "/pollresult": true, "/pollend": true, "/report": true, "/lockdown": true,
+	"/ignore": true, "/unignore": true, "/seen": true, "/announce": true, "/msg": true,
+	"/reply": true, "/whoami": true, "/status": true, "/color": true, "/features": true,
+	"/version": true, "/file": true, "/getfile": true, "/resume": true, "/roll": true,
+	"/react": true, "/reactions": true, "/edit": true, "/delete": true, "/sendfile": true,
+	"/export": true, "/whois": true, "/join": true, "/rooms": true, "/kickall": true,
+	"/eol": true, "/timestamps": true, "/audit": true, "/cmdlog": true, "/topic": true,
+	"/topichistory": true, "/get": true, "/lurk": true, "/unlurk": true, "/help": true,
+}
+
+// ParseAliases parses a comma-separated list of alias=command pairs, such
+// as "/w=/msg,/j=/join". Every command must be built in. An alias named
+// like a built-in command is dropped with a warning, since it would change
+// what that command does.
+func ParseAliases(list string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		alias, command, ok := strings.Cut(field, "=")
+		alias, command = strings.TrimSpace(alias), strings.TrimSpace(command)
+		if !ok || !strings.HasPrefix(alias, "/") || len(alias) < 2 || strings.ContainsAny(alias, " \t") {
+			return nil, fmt.Errorf("invalid alias %q, want /alias=/command", field)
+		}
+		if !builtinCommands[command] {
+			return nil, fmt.Errorf("alias %s: unknown command %q", alias, command)
+		}
+		if builtinCommands[alias] {
+			log.Printf("Ignoring alias %s=%s: %s is a built-in command.", alias, command, alias)
+			continue
+		}
+		aliases[alias] = command
+	}
+	return aliases, nil
+}
+
+// resolveAlias rewrites a message starting with an alias to use the
+// command it stands for.
+func (s *Server) resolveAlias(message string) string {
+	name, args, hasArgs := strings.Cut(message, " ")
+	command, ok := s.Aliases[name]
+	if !ok {
+		return message
+	}
+	if hasArgs {
+		return command + " " + args
+	}
+	return command
+}
+
+// sendHelp handles /help, listing the built-in commands and any aliases.
+func (s *Server) sendHelp(client *Client) {
+	commands := make([]string, 0, len(builtinCommands))
+	for command := range builtinCommands {
+		commands = append(commands, command)
+	}
+	slices.Sort(commands)
+	help := "Commands: " + strings.Join(commands, " ") + "\n"
+	if len(s.Aliases) > 0 {
+		aliases := make([]string, 0, len(s.Aliases))
+		for alias, command := range s.Aliases {
+			aliases = append(aliases, alias+"="+command)
+		}
+		slices.Sort(aliases)
+		help += "Aliases: " + strings.Join(aliases, " ") + "\n"
+	}
+	s.reply(client.Conn, help)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"testing"
+)
+
+// TestAliases tests that an alias runs the command it stands for.
+func TestAliases(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Aliases = map[string]string{"/w": "/msg", "/bye": "/exit"}
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+
+	alice.send("/w Bob psst")
+	bob.expect("[PM from Alice]: psst")
+	alice.send("/bye")
+	bob.expect("Alice left the chat")
+}
+
+// TestParseAliases tests alias list parsing, including that aliases can't
+// replace built-in commands.
+func TestParseAliases(t *testing.T) {
+	aliases, err := ParseAliases(" /w=/msg, /j = /join,/msg=/shout,")
+	if err != nil {
+		t.Fatalf("ParseAliases: %v", err)
+	}
+	if len(aliases) != 2 || aliases["/w"] != "/msg" || aliases["/j"] != "/join" {
+		t.Errorf("Got %v, want /w and /j only", aliases)
+	}
+
+	for _, list := range []string{"w=/msg", "/w", "/w=/whisper", "/w=/j", "/=/msg"} {
+		if _, err := ParseAliases(list); err == nil {
+			t.Errorf("ParseAliases(%q) succeeded", list)
+		}
+	}
+}
+
+// TestBuiltinCommandsInSync tests that builtinCommands lists every command
+// handleCommand dispatches.
+func TestBuiltinCommandsInSync(t *testing.T) {
+	source, err := os.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range regexp.MustCompile(`case "(/\w+)":`).FindAllStringSubmatch(string(source), -1) {
+		if !builtinCommands[match[1]] {
+			t.Errorf("%s is missing from builtinCommands", match[1])
+		}
+	}
+}
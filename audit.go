@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxAuditEvents is how many activity log entries /audit can show.
+const MaxAuditEvents = 200
+
+// DefaultAuditCount is how many entries /audit shows without an argument.
+const DefaultAuditCount = 10
+
+// AuditEvent is an entry written by logActivity.
+type AuditEvent struct {
+	Time time.Time
+	Text string
+}
+
+// recordAudit adds an event to the ring buffer, overwriting the oldest one
+// once it is full.
+func (s *Server) recordAudit(text string) {
+	s.AuditLock.Lock()
+	defer s.AuditLock.Unlock()
+
+	event := AuditEvent{Time: time.Now(), Text: text}
+	if len(s.audit) < MaxAuditEvents {
+		s.audit = append(s.audit, event)
+	} else {
+		s.audit[s.auditNext] = event
+	}
+	s.auditNext = (s.auditNext + 1) % MaxAuditEvents
+}
+
+// recentAudit returns up to n events, newest first.
+func (s *Server) recentAudit(n int) []AuditEvent {
+	s.AuditLock.Lock()
+	defer s.AuditLock.Unlock()
+
+	size := len(s.audit)
+	if n > size {
+		n = size
+	}
+	events := make([]AuditEvent, n)
+	for i := range events {
+		events[i] = s.audit[(s.auditNext-1-i+size)%size]
+	}
+	return events
+}
+
+// sendAudit handles /audit [n], showing admins the latest activity.
+func (s *Server) sendAudit(client *Client, args string) {
+	if !s.isAdmin(client) {
+		s.reply(client.Conn, "Only admins can view the audit log.\n")
+		return
+	}
+	n := DefaultAuditCount
+	if args != "" {
+		var err error
+		n, err = strconv.Atoi(args)
+		if err != nil || n < 1 {
+			s.reply(client.Conn, "Usage: /audit [count]\n")
+			return
+		}
+	}
+
+	var b strings.Builder
+	for _, event := range s.recentAudit(n) {
+		fmt.Fprintf(&b, "[AUDIT]: [%s] %s\n", event.Time.In(s.Location).Format(TimeFormat), event.Text)
+	}
+	if b.Len() == 0 {
+		b.WriteString("No activity yet.\n")
+	}
+	s.reply(client.Conn, b.String())
+}
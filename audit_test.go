@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestAudit tests that /audit lists recent activity newest first and is
+// only available to admins.
+func TestAudit(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+	admin.expect("Bob joined the chat")
+
+	bob.send("/name Robert")
+	admin.expect("Bob changed their name to Robert")
+	bob.send("/audit")
+	bob.expect("Only admins can view the audit log.")
+	bob.send("/exit")
+	admin.expect("Robert left the chat")
+
+	admin.send("/audit 3")
+	want := []string{"Client Robert left", "Client Bob changed their name to Robert", "Client Bob joined."}
+	for _, w := range want {
+		if line := admin.next(); !strings.HasPrefix(line, "[AUDIT]: ") || !strings.Contains(line, w) {
+			t.Fatalf("Got %q, want an audit line containing %q", line, w)
+		}
+	}
+	admin.expectNone("[AUDIT]")
+}
+
+// TestAuditBounded tests that the audit buffer keeps only the newest
+// MaxAuditEvents entries.
+func TestAuditBounded(t *testing.T) {
+	server, _ := startTestServer(t)
+	for i := 0; i < MaxAuditEvents+5; i++ {
+		server.logActivity(fmt.Sprintf("event %d", i))
+	}
+
+	events := server.recentAudit(MaxAuditEvents + 5)
+	if len(events) != MaxAuditEvents {
+		t.Fatalf("Kept %d events, want %d", len(events), MaxAuditEvents)
+	}
+	if newest := events[0].Text; newest != fmt.Sprintf("event %d", MaxAuditEvents+4) {
+		t.Errorf("Newest event is %q", newest)
+	}
+	if oldest := events[len(events)-1].Text; oldest != "event 5" {
+		t.Errorf("Oldest event is %q", oldest)
+	}
+}
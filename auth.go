@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"strings"
+)
+
+// MaxPasswordLen is the longest password line read, in bytes, so an
+// unauthenticated peer can't make the server buffer an endless line.
+const MaxPasswordLen = 1024
+
+// errPasswordTooLong is returned by StaticPasswordAuth when the password
+// line passes MaxPasswordLen.
+var errPasswordTooLong = errors.New("Password too long.")
+
+// Authenticator decides whether a connection may join under username. It
+// is called after the name is read and before the client is registered,
+// and may talk to the client over conn, e.g. to ask for a password.
+type Authenticator interface {
+	Authenticate(username string, conn net.Conn) (bool, error)
+}
+
+// NoAuth lets everyone in. It is the default.
+type NoAuth struct{}
+
+func (NoAuth) Authenticate(string, net.Conn) (bool, error) { return true, nil }
+
+// StaticPasswordAuth asks every client for the same shared password.
+type StaticPasswordAuth struct {
+	Password string
+}
+
+func (a StaticPasswordAuth) Authenticate(username string, conn net.Conn) (bool, error) {
+	if _, err := conn.Write([]byte("Password: ")); err != nil {
+		return false, err
+	}
+	line, err := readConnLine(conn, MaxPasswordLen)
+	if err != nil {
+		return false, err
+	}
+	ok := subtle.ConstantTimeCompare([]byte(strings.TrimSpace(line)), []byte(a.Password)) == 1
+	return ok, nil
+}
+
+// readConnLine reads up to the next newline, one byte at a time so nothing
+// past the line is consumed. It gives up with errPasswordTooLong once the
+// line, not counting a trailing "\r", passes max bytes.
+func readConnLine(conn net.Conn, max int) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+		if n := len(line); n > max && !(n == max+1 && b[0] == '\r') {
+			return "", errPasswordTooLong
+		}
+	}
+}
+
+// bufferedConn is a connection whose reads go through the client's line
+// reader, so authenticators see input that is already buffered, and whose
+// writes are rendered as replies, so their prompts are signed too.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	format Formatter
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+
+func (c bufferedConn) Write(p []byte) (int, error) {
+	if _, err := c.Conn.Write([]byte(c.format.Reply(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestNoAuth tests that the default authenticator lets everyone join.
+func TestNoAuth(t *testing.T) {
+	server, addr := startTestServer(t)
+	if _, ok := server.Auth.(NoAuth); !ok {
+		t.Fatalf("Default authenticator is %T, want NoAuth", server.Auth)
+	}
+	joinClient(t, addr, "Alice")
+}
+
+// TestStaticPasswordAuth tests that clients must send the shared password
+// after their name.
+func TestStaticPasswordAuth(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Auth = StaticPasswordAuth{Password: "hunter2"}
+	})
+
+	alice := dialClient(t, addr)
+	alice.send("Alice")
+	alice.send("hunter2")
+	alice.expect("Alice joined the chat")
+
+	mallory := dialClient(t, addr)
+	mallory.send("Mallory")
+	mallory.send("guess")
+	mallory.expect("Authentication failed.")
+	mallory.expect("disconnected: authentication failed")
+	mallory.expectClosed()
+	alice.expectNone("Mallory")
+}
+
+// TestPasswordTooLong tests that the password prompt stops reading once
+// the line passes MaxPasswordLen, and that a password of exactly that
+// length is accepted.
+func TestPasswordTooLong(t *testing.T) {
+	password := strings.Repeat("p", MaxPasswordLen)
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Auth = StaticPasswordAuth{Password: password}
+	})
+
+	alice := dialClient(t, addr)
+	alice.send("Alice")
+	alice.conn.Write([]byte(password + "\r\n"))
+	alice.expect("Alice joined the chat")
+
+	eve := dialClient(t, addr)
+	eve.send("Eve")
+	eve.conn.Write([]byte(password + "pp")) // no newline
+	eve.expect("Password too long.")
+	eve.expect("disconnected: password too long")
+	eve.expectClosed()
+}
+
+// prefixAuth admits only names starting with prefix, and fails outright
+// for names starting with "error".
+type prefixAuth struct {
+	prefix string
+}
+
+func (a prefixAuth) Authenticate(username string, conn net.Conn) (bool, error) {
+	if strings.HasPrefix(username, "error") {
+		return false, errors.New("backend unavailable")
+	}
+	return strings.HasPrefix(username, a.prefix), nil
+}
+
+// TestCustomAuth tests that an embedder's authenticator decides who joins.
+func TestCustomAuth(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Auth = prefixAuth{prefix: "staff-"}
+	})
+	joinClient(t, addr, "staff-alice")
+
+	guest := dialClient(t, addr)
+	guest.send("guest")
+	guest.expect("Authentication failed.")
+	guest.expect("disconnected: authentication failed")
+	guest.expectClosed()
+
+	broken := dialClient(t, addr)
+	broken.send("error-bob")
+	broken.expect("disconnected: authentication error")
+	broken.expectClosed()
+}
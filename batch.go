@@ -0,0 +1,60 @@
+package main
+
+import "time"
+
+// MaxBatchBytes is how much output is held for a client before it is
+// written without waiting for the rest of the BatchInterval.
+const MaxBatchBytes = 16 * 1024
+
+// sendBatched is sendMessagesToClient for servers with a BatchInterval.
+// Lines queued within the interval of the first one are written together,
+// so no line waits longer than BatchInterval.
+func (s *Server) sendBatched(client *Client) {
+	var batch []byte
+	var lines int64
+	timer := time.NewTimer(s.BatchInterval)
+	timer.Stop()
+	defer timer.Stop()
+
+	flush := func() bool {
+		if _, err := client.Conn.Write(batch); err != nil {
+			s.disconnect(client, "write failed")
+			return false
+		}
+		client.delivered.Add(lines)
+		batch, lines = batch[:0], 0
+		return true
+	}
+
+	for {
+		if lines == 0 {
+			msg, ok := <-client.Out
+			if !ok {
+				return
+			}
+			batch, lines = append(batch, msg...), 1
+			timer.Reset(s.BatchInterval)
+		} else {
+			select {
+			case msg, ok := <-client.Out:
+				if !ok {
+					flush()
+					return
+				}
+				batch = append(batch, msg...)
+				lines++
+			case <-timer.C:
+				if !flush() {
+					return
+				}
+				continue
+			}
+		}
+		if len(batch) >= MaxBatchBytes {
+			timer.Stop()
+			if !flush() {
+				return
+			}
+		}
+	}
+}
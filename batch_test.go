@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeConn records the writes made to it.
+type writeConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes []string
+}
+
+func (c *writeConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes = append(c.writes, string(p))
+	return len(p), nil
+}
+
+func (c *writeConn) written() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.writes...)
+}
+
+// TestBatchedOrder tests that batched output keeps every line in order while
+// using fewer writes than lines.
+func TestBatchedOrder(t *testing.T) {
+	server := newTestServer(t, TCP, "0")
+	defer server.Shutdown()
+	server.BatchInterval = 20 * time.Millisecond
+	conn := &writeConn{}
+	client := &Client{Username: "reader", Conn: conn, Out: make(chan string, 100)}
+
+	var want strings.Builder
+	for i := 0; i < 100; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		want.WriteString(line)
+		client.Out <- line
+	}
+	close(client.Out)
+	server.sendMessagesToClient(client)
+
+	writes := conn.written()
+	if got := strings.Join(writes, ""); got != want.String() {
+		t.Errorf("Got output %q, want %q", got, want.String())
+	}
+	if len(writes) >= 100 {
+		t.Errorf("Got %d writes for 100 lines, want them batched", len(writes))
+	}
+	if n := client.delivered.Load(); n != 100 {
+		t.Errorf("Counted %d delivered lines, want 100", n)
+	}
+}
+
+// TestBatchedLatency tests that a lone line is written once the batch
+// interval elapses rather than waiting for more output.
+func TestBatchedLatency(t *testing.T) {
+	server := newTestServer(t, TCP, "0")
+	defer server.Shutdown()
+	server.BatchInterval = 20 * time.Millisecond
+	conn := &writeConn{}
+	client := &Client{Username: "reader", Conn: conn, Out: make(chan string, 1)}
+	done := make(chan struct{})
+	go func() {
+		server.sendMessagesToClient(client)
+		close(done)
+	}()
+	defer func() {
+		close(client.Out)
+		<-done
+	}()
+
+	client.Out <- "hello\n"
+	deadline := time.Now().Add(time.Second)
+	for len(conn.written()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Line still not written after a second")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := conn.written(); len(got) != 1 || got[0] != "hello\n" {
+		t.Errorf("Got writes %q, want one \"hello\\n\"", got)
+	}
+}
+
+// benchmarkSend measures delivering 200-byte lines to a loopback TCP
+// connection with the given batch interval.
+func benchmarkSend(b *testing.B, interval time.Duration) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	server := newTestServer(b, TCP, "0")
+	defer server.Shutdown()
+	server.BatchInterval = interval
+	client := &Client{Username: "reader", Conn: conn, Out: make(chan string, 100)}
+	line := strings.Repeat("x", 199) + "\n"
+
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+	done := make(chan struct{})
+	go func() {
+		server.sendMessagesToClient(client)
+		close(done)
+	}()
+	for i := 0; i < b.N; i++ {
+		client.Out <- line
+	}
+	close(client.Out)
+	<-done
+}
+
+func BenchmarkSendPerLine(b *testing.B) { benchmarkSend(b, 0) }
+func BenchmarkSendBatched(b *testing.B) { benchmarkSend(b, time.Millisecond) }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxCommandEvents is how many commands /cmdlog can show.
+const MaxCommandEvents = 200
+
+// DefaultCommandCount is how many commands /cmdlog shows without an argument.
+const DefaultCommandCount = 10
+
+// cmdLogTargets lists the commands whose argument is a username, which is
+// kept in the command log. Arguments of other commands (private messages,
+// poll questions, ...) are never recorded.
+var cmdLogTargets = map[string]bool{
+	"/ignore":   true,
+	"/unignore": true,
+	"/promote":  true,
+	"/demote":   true,
+	"/whois":    true,
+	"/seen":     true,
+}
+
+// CommandEvent is a command run by a client.
+type CommandEvent struct {
+	Time    time.Time
+	User    string
+	Command string
+	Target  string // username argument, only for commands in cmdLogTargets
+}
+
+// recordCommand adds a command to the ring buffer, overwriting the oldest
+// one once it is full.
+func (s *Server) recordCommand(user, command, args string) {
+	event := CommandEvent{Time: time.Now(), User: user, Command: command}
+	if cmdLogTargets[command] {
+		event.Target, _, _ = strings.Cut(args, " ")
+	}
+
+	s.CmdLogLock.Lock()
+	defer s.CmdLogLock.Unlock()
+	if len(s.cmdLog) < MaxCommandEvents {
+		s.cmdLog = append(s.cmdLog, event)
+	} else {
+		s.cmdLog[s.cmdLogNext] = event
+	}
+	s.cmdLogNext = (s.cmdLogNext + 1) % MaxCommandEvents
+}
+
+// recentCommands returns up to n commands, newest first.
+func (s *Server) recentCommands(n int) []CommandEvent {
+	s.CmdLogLock.Lock()
+	defer s.CmdLogLock.Unlock()
+
+	size := len(s.cmdLog)
+	if n > size {
+		n = size
+	}
+	events := make([]CommandEvent, n)
+	for i := range events {
+		events[i] = s.cmdLog[(s.cmdLogNext-1-i+size)%size]
+	}
+	return events
+}
+
+// sendCmdLog handles /cmdlog [n], showing admins who ran which commands.
+func (s *Server) sendCmdLog(client *Client, args string) {
+	if !s.isAdmin(client) {
+		s.reply(client.Conn, "Only admins can view the command log.\n")
+		return
+	}
+	n := DefaultCommandCount
+	if args != "" {
+		var err error
+		n, err = strconv.Atoi(args)
+		if err != nil || n < 1 {
+			s.reply(client.Conn, "Usage: /cmdlog [count]\n")
+			return
+		}
+	}
+
+	var b strings.Builder
+	for _, event := range s.recentCommands(n) {
+		fmt.Fprintf(&b, "[CMD]: [%s] %s %s", event.Time.In(s.Location).Format(TimeFormat), event.User, event.Command)
+		if event.Target != "" {
+			b.WriteString(" " + event.Target)
+		}
+		b.WriteString("\n")
+	}
+	if b.Len() == 0 {
+		b.WriteString("No commands yet.\n")
+	}
+	s.reply(client.Conn, b.String())
+}
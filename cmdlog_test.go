@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestCmdLog tests that /cmdlog lists recent commands newest first, keeps
+// moderation targets and leaves out private message contents.
+func TestCmdLog(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+	admin.expect("Bob joined the chat")
+
+	bob.send("/ignore Admin")
+	bob.expect("You are now ignoring Admin.")
+	bob.send("/msg Admin secret plans")
+	admin.expect("secret plans")
+	bob.send("/cmdlog")
+	bob.expect("Only admins can view the command log.")
+	// Commands are recorded once they have run, so wait for the next line
+	bob.send("done")
+	admin.expect("done")
+
+	admin.send("/cmdlog 3")
+	want := []string{"Bob /cmdlog", "Bob /msg", "Bob /ignore Admin"}
+	for _, w := range want {
+		line := strings.TrimSuffix(admin.next(), "\n")
+		if !strings.HasPrefix(line, "[CMD]: ") || !strings.HasSuffix(line, w) {
+			t.Fatalf("Got %q, want a command line ending in %q", line, w)
+		}
+	}
+	admin.expectNone("[CMD]")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// nameColors are the ANSI colors usernames can be shown in with -color.
+var nameColors = map[string]string{
+	"red":     "\x1b[31m",
+	"green":   "\x1b[32m",
+	"yellow":  "\x1b[33m",
+	"blue":    "\x1b[34m",
+	"magenta": "\x1b[35m",
+	"cyan":    "\x1b[36m",
+}
+
+const colorReset = "\x1b[0m"
+
+// colorNames returns the supported color names in order.
+func colorNames() []string {
+	names := make([]string, 0, len(nameColors))
+	for name := range nameColors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// colorize wraps name in its color: the one given, or else one derived
+// from the name so each user keeps the same color.
+func colorize(name, color string) string {
+	code, ok := nameColors[color]
+	if !ok {
+		names := colorNames()
+		h := fnv.New32a()
+		h.Write([]byte(foldName(name)))
+		code = nameColors[names[h.Sum32()%uint32(len(names))]]
+	}
+	return code + name + colorReset
+}
+
+// setColor handles /color <name>, choosing the color client's name is shown
+// in. /color alone goes back to the default.
+func (s *Server) setColor(client *Client, name string) {
+	name = strings.ToLower(name)
+	if name == "" {
+		s.ClientsLock.Lock()
+		client.Color = ""
+		s.ClientsLock.Unlock()
+		client.Conn.Write([]byte("Your name color is back to the default.\n"))
+		return
+	}
+	if _, ok := nameColors[name]; !ok {
+		client.Conn.Write([]byte(fmt.Sprintf("Unknown color %q. Choose one of: %s.\n", name, strings.Join(colorNames(), ", "))))
+		return
+	}
+	s.ClientsLock.Lock()
+	client.Color = name
+	s.ClientsLock.Unlock()
+	client.Conn.Write([]byte(fmt.Sprintf("Your name color is now %s.\n", name)))
+}
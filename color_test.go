@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestColor tests that /color changes the ANSI color of the sender's name
+// and that unknown colors are refused.
+func TestColor(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Colors = true
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("/color mauve")
+	alice.expect(`Unknown color "mauve"`)
+
+	alice.send("/color Green")
+	alice.expect("Your name color is now green.")
+	alice.send("hello")
+	if line := bob.expect("hello"); !strings.Contains(line, "[\x1b[32mAlice\x1b[0m]: hello") {
+		t.Errorf("Got %q, want Alice in green", line)
+	}
+}
+
+// TestColorDefault tests that a name without a chosen color always gets the
+// same one.
+func TestColorDefault(t *testing.T) {
+	if colorize("Alice", "") != colorize("alice", "")[:5]+"Alice"+colorReset {
+		t.Error("Default color depends on the name's case")
+	}
+	if got := colorize("Bob", "cyan"); got != "\x1b[36mBob\x1b[0m" {
+		t.Errorf("colorize(Bob, cyan) = %q", got)
+	}
+}
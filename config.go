@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configAliases maps readable config-file keys to their flag names.
+var configAliases = map[string]string{
+	"listen":   "l",
+	"port":     "p",
+	"protocol": "u",
+}
+
+// Config holds the server settings given on the command line or in a
+// config file.
+type Config struct {
+	Listen            bool
+	Check             bool
+	Port              string
+	Protocol          string
+	Output            string
+	BotTime           string
+	ShowSeq           bool
+	History           string
+	HistoryMax        int
+	HistoryBytes      int
+	LogFile           string
+	LogChat           bool
+	ChatLog           string
+	LogMaxSize        int64
+	LogKeep           int
+	ExportDir         string
+	SendFileDir       string
+	IgnoreFile        string
+	MaxRooms          int
+	RoomIdle          time.Duration
+	TimeZone          string
+	NameRetries       int
+	AllowGuest        bool
+	NoDupes           bool
+	Confirm           bool
+	Colors            bool
+	Fanout            int
+	AllowHalfClose    bool
+	WS                string
+	PollAdmin         bool
+	AdminMode         string
+	AdminPass         string
+	KeepAdmin         bool
+	PollTime          time.Duration
+	FullMessage       string
+	SlotMessage       string
+	Presence          time.Duration
+	Tips              string
+	TipInterval       time.Duration
+	MaxClients        int
+	MaxGoroutines     int
+	ShowCap           bool
+	LogThrottle       time.Duration
+	BatchMS           int
+	Queue             int
+	BufSize           int
+	IdleTimeout       time.Duration
+	IdleWarning       time.Duration
+	MaxMsgLen         int
+	MaxNameLen        int
+	NameRunes         bool
+	NameTimeout       time.Duration
+	Password          string
+	WhoisPublic       bool
+	Reconnects        int
+	ReconnectWindow   time.Duration
+	ReconnectCooldown time.Duration
+	HMACSecret        string
+	Frames            bool
+	ProxyProtocol     bool
+	CompressOver      int
+	AllowCIDR         string
+	Aliases           string
+	DenyCIDR          string
+	Missed            bool
+	MOTD              string
+	Logo              string
+	NoLogo            bool
+	WSLogo            string
+	BanList           string
+	AllowList         string
+	Args              []string // positional arguments left after the flags
+}
+
+// ParseConfig parses command-line arguments. If -config names a file, its
+// settings are applied first so that flags on the command line win.
+func ParseConfig(args []string) (*Config, error) {
+	c := &Config{}
+	fs := flag.NewFlagSet("TCPChat", flag.ContinueOnError)
+	fs.BoolVar(&c.Listen, "l", false, "Listen for incoming connections")
+	fs.BoolVar(&c.Check, "check", false, "Validate the configuration and exit without listening")
+	fs.StringVar(&c.Port, "p", DefaultPort, "Port to listen on")
+	fs.StringVar(&c.Protocol, "u", string(TCP), "Choose between tcp or udp")
+	fs.StringVar(&c.Output, "proto", "human", "Output format: human, or line for bots")
+	fs.StringVar(&c.BotTime, "botts", "epochms", "Message times in -proto line: epochms, rfc3339 or none")
+	fs.BoolVar(&c.ShowSeq, "seq", false, "Show message sequence numbers (used by /reply)")
+	fs.StringVar(&c.LogFile, "logfile", DefaultLogFile, "Write the activity log to this file")
+	fs.BoolVar(&c.LogChat, "logchat", false, "Also write chat messages to the activity log")
+	fs.StringVar(&c.ChatLog, "chatlog", "", "Write chat messages to this file instead (rotated like the activity log)")
+	fs.Int64Var(&c.LogMaxSize, "logmaxsize", 0, "Rotate the log file once it would exceed this many bytes; 0 disables")
+	fs.IntVar(&c.LogKeep, "logkeep", DefaultLogKeep, "Rotated log files to keep")
+	fs.IntVar(&c.HistoryMax, "hmax", 0, "Replay at most this many messages to new clients; 0 means no limit")
+	fs.IntVar(&c.HistoryBytes, "hbytes", 0, "Replay at most this many bytes of messages to new clients; 0 means no limit")
+	fs.StringVar(&c.History, "history", "", "Persist chat history to this file (gzip-compressed if it ends in .gz)")
+	fs.IntVar(&c.MaxRooms, "maxrooms", DefaultMaxRooms, "Maximum number of rooms (0 means no limit)")
+	fs.DurationVar(&c.RoomIdle, "roomidle", DefaultRoomIdle, "Remove rooms that have been empty this long (0 keeps them)")
+	fs.StringVar(&c.IgnoreFile, "ignorefile", "", "File to keep users' ignore lists in across restarts")
+	fs.StringVar(&c.SendFileDir, "sendfiledir", "", "Directory /sendfile reads files from (empty disables /sendfile)")
+	fs.StringVar(&c.ExportDir, "exportdir", ".", "Directory /export writes history snapshots to")
+	fs.StringVar(&c.TimeZone, "tz", "Local", "Time zone for message timestamps: UTC, Local or an IANA name")
+	fs.BoolVar(&c.AllowGuest, "allowguest", false, "Give clients that enter an empty name a Guest-NNNN name")
+	fs.IntVar(&c.NameRetries, "nameretries", DefaultNameRetries, "How many times a client may retry an invalid or taken username")
+	fs.BoolVar(&c.Colors, "color", false, "Show usernames in ANSI colors in human output (see /color)")
+	fs.StringVar(&c.AdminMode, "adminmode", string(AdminFirst), "Who is admin: first (the first client to join), password (clients that run /admin with -adminpass) or none")
+	fs.StringVar(&c.AdminPass, "adminpass", "", "Password for /admin with -adminmode password")
+	fs.BoolVar(&c.KeepAdmin, "keepadmin", true, "Refuse to /demote the last admin")
+	fs.BoolVar(&c.PollAdmin, "polladmin", false, "Only let admins start polls")
+	fs.DurationVar(&c.PollTime, "polltime", DefaultPollDuration, "How long polls stay open")
+	fs.StringVar(&c.WS, "ws", "", "Also accept WebSocket clients on this address (e.g. :8080)")
+	fs.BoolVar(&c.AllowHalfClose, "allowhalfclose", false, "Keep delivering to clients that close their sending side, until a write fails")
+	fs.IntVar(&c.Fanout, "fanout", 0, "Render each broadcast with this many workers, for servers with many clients; 0 disables")
+	fs.BoolVar(&c.Confirm, "confirm", false, "Send authors a short receipt after each of their messages is broadcast")
+	fs.BoolVar(&c.NoDupes, "nodupes", false, "Drop messages identical to the sender's previous one")
+	fs.StringVar(&c.FullMessage, "fullmsg", DefaultFullMessage, "Message sent to clients rejected because the server is full")
+	fs.StringVar(&c.SlotMessage, "slotmsg", DefaultSlotMessage, "Info line sent to a queued client when a slot opens for it; empty sends none")
+	fs.DurationVar(&c.Presence, "presence", 0, "Broadcast the number of online users at this interval (e.g. 1m); 0 disables")
+	fs.StringVar(&c.Tips, "tips", "", "Broadcast the lines of this file in turn, one every -tipinterval")
+	fs.DurationVar(&c.TipInterval, "tipinterval", DefaultTipInterval, "Interval between -tips broadcasts")
+	fs.IntVar(&c.MaxClients, "maxclients", DefaultMaxClients, "Maximum number of connected clients")
+	fs.DurationVar(&c.LogThrottle, "logthrottle", 0, "Log rejected connections, early closes and slow clients at most once per interval, counting the rest (0 disables)")
+	fs.BoolVar(&c.ShowCap, "showcap", false, "Tell new connections how many client slots are in use")
+	fs.IntVar(&c.MaxGoroutines, "maxgoroutines", DefaultMaxGoroutines, "Maximum number of client goroutines, a safety net beyond -maxclients (0 disables)")
+	fs.IntVar(&c.BatchMS, "batchms", 0, "Gather each client's output for up to this many milliseconds into a single write; 0 writes every line at once")
+	fs.IntVar(&c.Queue, "queue", 0, "Hold up to this many connections in a queue when the server is full; 0 rejects them")
+	fs.IntVar(&c.BufSize, "bufsize", DefaultBufSize, fmt.Sprintf("Read buffer size in bytes (at least %d)", MinBufSize))
+	fs.DurationVar(&c.IdleTimeout, "idle", 0, "Disconnect clients inactive for this long (e.g. 10m); 0 disables")
+	fs.DurationVar(&c.IdleWarning, "idlewarn", DefaultIdleWarning, "Warn idle clients this long before disconnecting them; 0 disables")
+	fs.IntVar(&c.MaxMsgLen, "maxmsglen", 0, "Truncate messages longer than this many bytes; 0 disables")
+	fs.DurationVar(&c.NameTimeout, "nametimeout", DefaultNameTimeout, "Disconnect clients that haven't entered a name (and password) within this time; 0 disables")
+	fs.IntVar(&c.MaxNameLen, "maxnamelen", DefaultMaxNameLen, "Refuse usernames longer than this many bytes (characters with -namerunes)")
+	fs.BoolVar(&c.NameRunes, "namerunes", false, "Count -maxnamelen in Unicode characters (code points) instead of bytes")
+	fs.BoolVar(&c.Missed, "missed", false, "Tell returning users how many messages they missed")
+	fs.StringVar(&c.HMACSecret, "hmacsecret", "", "Sign each line-protocol line with an HMAC-SHA256 using this secret")
+	fs.IntVar(&c.Reconnects, "reconnects", 0, "Connections allowed per address within -reconnectwindow before it must back off; 0 disables")
+	fs.DurationVar(&c.ReconnectWindow, "reconnectwindow", DefaultReconnectWindow, "Window in which -reconnects connections are counted")
+	fs.DurationVar(&c.ReconnectCooldown, "reconnectcooldown", DefaultReconnectCooldown, "How long an address over -reconnects is refused")
+	fs.BoolVar(&c.Frames, "frames", false, "Send line-protocol output as length-prefixed frames, gzipping large ones")
+	fs.IntVar(&c.CompressOver, "compressover", DefaultCompressOver, "Gzip frames with payloads longer than this many bytes")
+	fs.BoolVar(&c.WhoisPublic, "whoispublic", false, "Let non-admins use /whois, without addresses and traffic")
+	fs.BoolVar(&c.ProxyProtocol, "proxyproto", false, "Expect a PROXY protocol v1 header from a load balancer on each connection")
+	fs.StringVar(&c.Password, "password", "", "Require clients to enter this password after their name")
+	fs.StringVar(&c.Aliases, "aliases", "", "Extra names for commands as comma-separated alias=command pairs (e.g. /w=/msg,/j=/join)")
+	fs.StringVar(&c.AllowCIDR, "allowcidr", "", "Only accept connections from these comma-separated CIDR ranges")
+	fs.StringVar(&c.DenyCIDR, "denycidr", "", "Refuse connections from these comma-separated CIDR ranges")
+	fs.StringVar(&c.MOTD, "motd", "", "Show this file's contents to clients when they join")
+	fs.StringVar(&c.Logo, "logo", "", "Show this file instead of the built-in logo on connect")
+	fs.StringVar(&c.WSLogo, "wslogo", "", "Show this file to WebSocket clients instead of the -logo (an empty file shows none)")
+	fs.BoolVar(&c.NoLogo, "nologo", false, "Skip the logo and go straight to the name prompt (overrides -logo)")
+	fs.StringVar(&c.BanList, "banlist", "", "Refuse connections from the IP addresses in this file")
+	fs.StringVar(&c.AllowList, "allowlist", "", "Only accept connections from the IP addresses in this file")
+	configFile := fs.String("config", "", "Read settings from this key=value file")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *configFile != "" {
+		if err := loadConfigFile(fs, *configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	c.Args = fs.Args()
+	if len(c.Args) == 1 {
+		c.Port = c.Args[0]
+	}
+	return c, nil
+}
+
+// loadConfigFile applies the key=value lines in path to fs. Keys are flag
+// names (or an alias from configAliases); blank lines and lines starting
+// with '#' are ignored. Flags already set on the command line are left
+// untouched.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	defer file.Close()
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key=value", path, lineNo)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if name, ok := configAliases[key]; ok {
+			key = name
+		}
+		if key == "config" || fs.Lookup(key) == nil {
+			return fmt.Errorf("%s:%d: unknown key %q", path, lineNo, key)
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %v", path, lineNo, key, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// usageError reports an invalid setting, as opposed to a failure to load
+// a file the configuration names.
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string { return e.err.Error() }
+
+// NewServer builds a server from the configuration, validating it first.
+// Invalid settings are reported as a *usageError.
+func (c *Config) NewServer() (*Server, error) {
+	transport, location, format, err := c.validate()
+	if err != nil {
+		return nil, &usageError{err}
+	}
+	aliases, err := ParseAliases(c.Aliases)
+	if err != nil {
+		return nil, &usageError{fmt.Errorf("aliases: %v", err)}
+	}
+	allow, err := ParseCIDRs(c.AllowCIDR)
+	if err != nil {
+		return nil, &usageError{fmt.Errorf("allowcidr: %v", err)}
+	}
+	deny, err := ParseCIDRs(c.DenyCIDR)
+	if err != nil {
+		return nil, &usageError{fmt.Errorf("denycidr: %v", err)}
+	}
+	adminMode, err := ParseAdminMode(c.AdminMode)
+	if err != nil {
+		return nil, &usageError{err}
+	}
+	if adminMode == AdminPassword && c.AdminPass == "" {
+		return nil, &usageError{fmt.Errorf("adminmode password needs -adminpass")}
+	}
+
+	server := NewServerWithOptions(WithProtocol(transport), WithPort(c.Port))
+	server.AdminMode = adminMode
+	server.AdminPassword = c.AdminPass
+	server.KeepAdmin = c.KeepAdmin
+	server.LogFile = &LogFile{Path: c.LogFile, MaxSize: c.LogMaxSize, Keep: c.LogKeep}
+	if err := c.openLog(server.LogFile); err != nil {
+		return nil, err
+	}
+	server.LogChat = c.LogChat
+	if c.ChatLog != "" {
+		server.ChatLog = &LogFile{Path: c.ChatLog, MaxSize: c.LogMaxSize, Keep: c.LogKeep}
+		if err := c.openLog(server.ChatLog); err != nil {
+			server.Shutdown()
+			return nil, err
+		}
+	}
+	server.AllowCIDRs = allow
+	server.Aliases = aliases
+	server.Frames = c.Frames
+	server.ProxyProtocol = c.ProxyProtocol
+	server.WhoisRedacted = c.WhoisPublic
+	server.CompressOver = c.CompressOver
+	server.ReconnectLimit = c.Reconnects
+	server.ReconnectWindow = c.ReconnectWindow
+	server.ReconnectCooldown = c.ReconnectCooldown
+	if c.Password != "" {
+		server.Auth = StaticPasswordAuth{Password: c.Password}
+	}
+	server.DenyCIDRs = deny
+	server.Location = location
+	server.Format = format
+	server.HistoryFile = c.History
+	server.HistoryMax = c.HistoryMax
+	server.HistoryBytes = c.HistoryBytes
+	server.ExportDir = c.ExportDir
+	server.SendFileDir = c.SendFileDir
+	server.IgnoreFile = c.IgnoreFile
+	server.MaxRooms = c.MaxRooms
+	server.RoomIdle = c.RoomIdle
+	server.NameRetries = c.NameRetries
+	server.AllowGuest = c.AllowGuest
+	server.NoDupes = c.NoDupes
+	server.Confirm = c.Confirm
+	server.Colors = c.Colors
+	server.Fanout = c.Fanout
+	server.AllowHalfClose = c.AllowHalfClose
+	server.WSAddr = c.WS
+	server.PollAdminOnly = c.PollAdmin
+	server.PollDuration = c.PollTime
+	server.FullMessage = c.FullMessage
+	server.SlotMessage = c.SlotMessage
+	server.Presence = c.Presence
+	server.TipInterval = c.TipInterval
+	if c.Tips != "" {
+		if server.Tips, err = ReadTips(c.Tips); err != nil {
+			server.Shutdown()
+			return nil, fmt.Errorf("reading tips: %w", err)
+		}
+	}
+	server.MaxClients = c.MaxClients
+	server.MaxGoroutines = c.MaxGoroutines
+	server.ShowCapacity = c.ShowCap
+	server.LogThrottle = c.LogThrottle
+	server.BatchInterval = time.Duration(c.BatchMS) * time.Millisecond
+	server.QueueSize = c.Queue
+	server.BufSize = c.BufSize
+	server.IdleTimeout = c.IdleTimeout
+	server.IdleWarning = c.IdleWarning
+	server.MaxMsgLen = c.MaxMsgLen
+	server.MaxNameLen = c.MaxNameLen
+	server.NameLenRunes = c.NameRunes
+	server.NameTimeout = c.NameTimeout
+	server.MissedNotice = c.Missed
+	server.MOTDFile = c.MOTD
+	server.LogoFile = c.Logo
+	server.NoLogo = c.NoLogo
+	server.WSLogoFile = c.WSLogo
+	server.BanFile = c.BanList
+	server.AllowFile = c.AllowList
+	if err := server.LoadFiles(); err != nil {
+		server.Shutdown()
+		return nil, err
+	}
+	if err := server.LoadHistory(); err != nil {
+		server.Shutdown()
+		return nil, err
+	}
+	if err := server.LoadIgnores(); err != nil {
+		server.Shutdown()
+		return nil, err
+	}
+	return server, nil
+}
+
+// openLog opens l, or with -check only makes sure it could be opened, so
+// that a dry run doesn't create log files.
+func (c *Config) openLog(l *LogFile) error {
+	if c.Check {
+		return l.Check()
+	}
+	return l.Open()
+}
+
+// validate checks the settings that don't involve reading files and
+// returns the parsed transport, time zone and output format.
+func (c *Config) validate() (Protocol, *time.Location, Formatter, error) {
+	transport, err := ParseProtocol(c.Protocol)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	location, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("invalid time zone %q: %v", c.TimeZone, err)
+	}
+	format, err := NewFormatter(c.Output)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if human, ok := format.(HumanFormatter); ok {
+		human.ShowSeq = c.ShowSeq
+		format = human
+	}
+	botTime, err := ParseBotTime(c.BotTime)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if line, ok := format.(LineFormatter); ok {
+		line.Time = botTime
+		format = line
+	}
+	if c.HMACSecret != "" {
+		line, ok := format.(LineFormatter)
+		if !ok {
+			return "", nil, nil, fmt.Errorf("hmacsecret needs -proto line")
+		}
+		line.Secret = []byte(c.HMACSecret)
+		format = line
+	}
+	if _, ok := format.(LineFormatter); c.Frames && !ok {
+		return "", nil, nil, fmt.Errorf("frames needs -proto line")
+	}
+	if c.MaxRooms < 0 {
+		return "", nil, nil, fmt.Errorf("maxrooms must not be negative, got %d", c.MaxRooms)
+	}
+	if c.RoomIdle < 0 {
+		return "", nil, nil, fmt.Errorf("roomidle must not be negative, got %s", c.RoomIdle)
+	}
+	if c.LogThrottle < 0 {
+		return "", nil, nil, fmt.Errorf("logthrottle must not be negative, got %s", c.LogThrottle)
+	}
+	if c.BatchMS < 0 {
+		return "", nil, nil, fmt.Errorf("batchms must not be negative, got %d", c.BatchMS)
+	}
+	if c.MaxGoroutines < 0 {
+		return "", nil, nil, fmt.Errorf("maxgoroutines must not be negative, got %d", c.MaxGoroutines)
+	}
+	if c.MaxClients < 1 {
+		return "", nil, nil, fmt.Errorf("maxclients must be at least 1, got %d", c.MaxClients)
+	}
+
+	if c.BufSize < MinBufSize {
+		return "", nil, nil, fmt.Errorf("bufsize must be at least %d, got %d", MinBufSize, c.BufSize)
+	}
+	if c.IdleTimeout > 0 && c.IdleWarning >= c.IdleTimeout {
+		return "", nil, nil, fmt.Errorf("idlewarn (%s) must be shorter than idle (%s)", c.IdleWarning, c.IdleTimeout)
+	}
+	if c.NameTimeout < 0 {
+		return "", nil, nil, fmt.Errorf("nametimeout must not be negative, got %s", c.NameTimeout)
+	}
+	if c.MaxMsgLen < 0 {
+		return "", nil, nil, fmt.Errorf("maxmsglen must not be negative, got %d", c.MaxMsgLen)
+	}
+	if c.HistoryMax < 0 || c.HistoryBytes < 0 {
+		return "", nil, nil, fmt.Errorf("hmax and hbytes must not be negative")
+	}
+	if c.PollTime <= 0 {
+		return "", nil, nil, fmt.Errorf("polltime must be positive, got %s", c.PollTime)
+	}
+	if c.WS != "" && transport != TCP {
+		return "", nil, nil, fmt.Errorf("ws needs -u tcp")
+	}
+	if c.WSLogo != "" && c.WS == "" {
+		return "", nil, nil, fmt.Errorf("wslogo needs -ws")
+	}
+	if c.Fanout < 0 {
+		return "", nil, nil, fmt.Errorf("fanout must not be negative, got %d", c.Fanout)
+	}
+	if c.LogMaxSize < 0 {
+		return "", nil, nil, fmt.Errorf("logmaxsize must not be negative, got %d", c.LogMaxSize)
+	}
+	if c.LogKeep < 0 {
+		return "", nil, nil, fmt.Errorf("logkeep must not be negative, got %d", c.LogKeep)
+	}
+	if c.MaxNameLen < 1 {
+		return "", nil, nil, fmt.Errorf("maxnamelen must be at least 1, got %d", c.MaxNameLen)
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 0 || port > 65535 {
+		return "", nil, nil, fmt.Errorf("invalid port %q", c.Port)
+	}
+	return transport, location, format, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file with the given contents and returns its
+// path.
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chat.conf")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+// TestConfigFile tests that config file values are used and that
+// command-line flags override them.
+func TestConfigFile(t *testing.T) {
+	path := writeConfig(t, `
+# Chat server settings
+port = 9100
+protocol = UDP
+maxclients = 3
+nodupes = true
+fullmsg = Full, try chat2.example.com
+presence = 2m
+`)
+	config, err := ParseConfig([]string{"-config", path, "-maxclients", "5"})
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	server, err := config.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer server.Shutdown()
+
+	if server.Port != "9100" || server.Protocol != UDP {
+		t.Errorf("Got port %s protocol %s, want 9100 udp", server.Port, server.Protocol)
+	}
+	if server.MaxClients != 5 {
+		t.Errorf("Command-line -maxclients should win: got %d", server.MaxClients)
+	}
+	if !server.NoDupes || server.FullMessage != "Full, try chat2.example.com" || server.Presence != 2*time.Minute {
+		t.Errorf("Config values not applied: %+v", config)
+	}
+}
+
+// TestConfigFileErrors tests that bad config files are rejected.
+func TestConfigFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown key":   "colour = red\n",
+		"missing value": "port\n",
+		"bad value":     "maxclients = many\n",
+	}
+	for name, contents := range tests {
+		path := writeConfig(t, contents)
+		if _, err := ParseConfig([]string{"-config", path}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if _, err := ParseConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.conf")}); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+// TestConfigPositionalPort tests that a port argument overrides the config.
+func TestConfigPositionalPort(t *testing.T) {
+	path := writeConfig(t, "port = 9100\n")
+	config, err := ParseConfig([]string{"-config", path, "9200"})
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	if config.Port != "9200" {
+		t.Errorf("Got port %s, want 9200", config.Port)
+	}
+}
+
+// TestConfigInvalidProtocol tests that NewServer validates the settings.
+func TestConfigInvalidProtocol(t *testing.T) {
+	config, err := ParseConfig([]string{"-u", "sctp"})
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	if _, err := config.NewServer(); err == nil || !strings.Contains(err.Error(), "sctp") {
+		t.Errorf("Expected an invalid protocol error, got %v", err)
+	}
+}
+
+// TestConfigBufSize tests that a too-small buffer size is rejected.
+func TestConfigBufSize(t *testing.T) {
+	config, err := ParseConfig([]string{"-bufsize", "16"})
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	if _, err := config.NewServer(); err == nil {
+		t.Error("Expected an error for a 16-byte buffer")
+	}
+}
+
+// TestExitCodes tests that each way of failing to start exits with its own
+// code.
+func TestExitCodes(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer busy.Close()
+	_, busyPort, _ := net.SplitHostPort(busy.Addr().String())
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.txt")
+	logFile := filepath.Join(dir, "server.log")
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"unknown flag", []string{"-bogus"}, ExitUsage},
+		{"bad protocol", []string{"-u", "sctp"}, ExitUsage},
+		{"bad port", []string{"-p", "99999"}, ExitUsage},
+		{"too many arguments", []string{"1", "2"}, ExitUsage},
+		{"unreadable motd", []string{"-motd", missing}, ExitError},
+		{"port in use", []string{"-p", busyPort}, ExitBind},
+		{"check valid", []string{"-check", "-p", busyPort}, ExitOK},
+		{"check bad port", []string{"-check", "-p", "99999"}, ExitUsage},
+		{"check unreadable motd", []string{"-check", "-motd", missing}, ExitError},
+		{"bad admin mode", []string{"-check", "-adminmode", "vote"}, ExitUsage},
+		{"admin password missing", []string{"-check", "-adminmode", "password"}, ExitUsage},
+		{"alias to unknown command", []string{"-check", "-aliases", "/w=/whisper"}, ExitUsage},
+		{"check unwritable log", []string{"-check", "-logfile", filepath.Join(missing, "server.log")}, ExitError},
+	}
+	for _, tt := range tests {
+		// Keep the runs from writing server.log in the package directory.
+		args := append([]string{"-logfile", logFile}, tt.args...)
+		if got := run(args); got != tt.want {
+			t.Errorf("%s: run(%q) = %d, want %d", tt.name, tt.args, got, tt.want)
+		}
+	}
+}
+
+// TestCheckCreatesNoFiles tests that -check leaves no log files behind.
+func TestCheckCreatesNoFiles(t *testing.T) {
+	dir := t.TempDir()
+	args := []string{"-check", "-p", "0",
+		"-logfile", filepath.Join(dir, "server.log"),
+		"-chatlog", filepath.Join(dir, "chat.log")}
+	if got := run(args); got != ExitOK {
+		t.Fatalf("run(%q) = %d, want %d", args, got, ExitOK)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("-check left %d files behind, e.g. %s", len(entries), entries[0].Name())
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+const (
+	MaxDice      = 100  // dice one /roll may throw
+	MaxDiceSides = 1000 // sides a die may have
+)
+
+// parseDice parses a dice spec such as "2d6" into the number of dice and
+// their sides. A missing count, as in "d20", means one die.
+func parseDice(spec string) (count, sides int, err error) {
+	countArg, sidesArg, ok := strings.Cut(strings.ToLower(spec), "d")
+	if !ok {
+		return 0, 0, fmt.Errorf("want NdM, like 2d6")
+	}
+	count = 1
+	if countArg != "" {
+		if count, err = strconv.Atoi(countArg); err != nil {
+			return 0, 0, fmt.Errorf("want NdM, like 2d6")
+		}
+	}
+	if sides, err = strconv.Atoi(sidesArg); err != nil {
+		return 0, 0, fmt.Errorf("want NdM, like 2d6")
+	}
+	if count < 1 || count > MaxDice {
+		return 0, 0, fmt.Errorf("roll between 1 and %d dice", MaxDice)
+	}
+	if sides < 2 || sides > MaxDiceSides {
+		return 0, 0, fmt.Errorf("dice need between 2 and %d sides", MaxDiceSides)
+	}
+	return count, sides, nil
+}
+
+// roll handles /roll <NdM>, showing the result to the client's room, except
+// to those ignoring it.
+func (s *Server) roll(client *Client, spec string) {
+	count, sides, err := parseDice(spec)
+	if err != nil {
+		s.reply(client.Conn, fmt.Sprintf("Usage: /roll <NdM>: %v.\n", err))
+		return
+	}
+	if s.lockedOut(client) {
+		return
+	}
+	rolls := make([]int, count)
+	for i := range rolls {
+		rolls[i] = 1 + rand.IntN(sides)
+	}
+	s.roomSend(s.clientRoom(client), s.Format.Dice(client.Username, fmt.Sprintf("%dd%d", count, sides), rolls), "", client.Username)
+}
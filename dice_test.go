@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestParseDice tests valid and invalid dice specs.
+func TestParseDice(t *testing.T) {
+	valid := map[string][2]int{"2d6": {2, 6}, "d20": {1, 20}, "3D8": {3, 8}, "100d1000": {100, 1000}}
+	for spec, want := range valid {
+		count, sides, err := parseDice(spec)
+		if err != nil || count != want[0] || sides != want[1] {
+			t.Errorf("parseDice(%q) = %d, %d, %v; want %d, %d", spec, count, sides, err, want[0], want[1])
+		}
+	}
+	for _, spec := range []string{"", "6", "0d0", "0d6", "2d1", "101d6", "2d1001", "xdy", "2d", "-1d6", "2d6d6"} {
+		if _, _, err := parseDice(spec); err == nil {
+			t.Errorf("parseDice(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+// TestRoll tests that /roll shows every die and the total to the room,
+// with each die in range.
+func TestRoll(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("/roll 0d0")
+	alice.expect("Usage: /roll <NdM>: roll between 1 and 100 dice.")
+
+	for i := 0; i < 20; i++ {
+		alice.send("/roll 3d6")
+		line := bob.expect("[DICE]: Alice rolled 3d6 → ")
+		alice.expect("[DICE]: Alice rolled 3d6 → ")
+
+		result := strings.TrimSpace(strings.TrimPrefix(line, "[DICE]: Alice rolled 3d6 → "))
+		rolls, total, _ := strings.Cut(result, "=")
+		sum := 0
+		for _, r := range strings.Split(rolls, "+") {
+			n, err := strconv.Atoi(r)
+			if err != nil || n < 1 || n > 6 {
+				t.Fatalf("Bad die %q in %q", r, line)
+			}
+			sum += n
+		}
+		if total != fmt.Sprint(sum) {
+			t.Fatalf("Total in %q should be %d", line, sum)
+		}
+	}
+}
+
+// TestRollIgnored tests that a client ignoring the roller doesn't see the
+// roll, while the roller and others still do.
+func TestRollIgnored(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	carol := joinClient(t, addr, "Carol")
+
+	bob.send("/ignore Alice")
+	bob.expect("You are now ignoring Alice.")
+	alice.send("/roll 2d6")
+	alice.expect("[DICE]: Alice rolled 2d6")
+	carol.expect("[DICE]: Alice rolled 2d6")
+	bob.expectNone("[DICE]")
+}
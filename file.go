@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileLineWidth is the length of the base64 lines sent by /getfile.
+const fileLineWidth = 76
+
+// MaxBroadcastFile is the largest file /sendfile pushes to the chat, in
+// bytes.
+const MaxBroadcastFile = 8 * 1024
+
+// SharedFile is a file uploaded with /file and kept in memory.
+type SharedFile struct {
+	Name     string
+	Owner    string
+	Data     []byte
+	Uploaded time.Time
+}
+
+// upload is a /file transfer in progress.
+type upload struct {
+	name    string
+	encoded strings.Builder
+	tooBig  bool
+}
+
+// startUpload handles /file <name>. The following lines are base64 data,
+// up to a line reading /endfile.
+func (s *Server) startUpload(client *Client, name string) {
+	if name == "" || strings.ContainsAny(name, " \t") {
+		s.reply(client.Conn, "Usage: /file <name>, then base64 lines, then /endfile\n")
+		return
+	}
+	client.upload = &upload{name: name}
+	s.reply(client.Conn, fmt.Sprintf("Receiving %s: send base64 lines, then /endfile.\n", name))
+}
+
+// receiveFileLine handles a line sent while an upload is in progress.
+// Oversized uploads are still read up to /endfile so the rest of the data
+// isn't mistaken for chat.
+func (s *Server) receiveFileLine(client *Client, line string) {
+	up := client.upload
+	if line != "/endfile" {
+		if !up.tooBig {
+			up.encoded.WriteString(line)
+			up.tooBig = base64.StdEncoding.DecodedLen(up.encoded.Len()) > s.MaxFileSize+2
+		}
+		return
+	}
+	client.upload = nil
+
+	data, err := base64.StdEncoding.DecodeString(up.encoded.String())
+	switch {
+	case up.tooBig || len(data) > s.MaxFileSize:
+		s.reply(client.Conn, fmt.Sprintf("File too large (max %d bytes).\n", s.MaxFileSize))
+		return
+	case err != nil:
+		s.reply(client.Conn, "Invalid base64 data.\n")
+		return
+	}
+
+	s.storeFile(&SharedFile{Name: up.name, Owner: client.Username, Data: data, Uploaded: time.Now()})
+	s.reply(client.Conn, fmt.Sprintf("Stored %s (%d bytes).\n", up.name, len(data)))
+	s.broadcast(s.Format.Info(fmt.Sprintf("%s shared %s (%d bytes), use /getfile %s", client.Username, up.name, len(data), up.name)), client.Username)
+	s.logActivity(fmt.Sprintf("Client %s uploaded %s (%d bytes).", client.Username, up.name, len(data)))
+}
+
+// storeFile keeps f, replacing any file with the same name and dropping
+// the oldest files until the store fits in MaxFileStore.
+func (s *Server) storeFile(f *SharedFile) {
+	s.FilesLock.Lock()
+	defer s.FilesLock.Unlock()
+
+	total := len(f.Data)
+	kept := s.Files[:0]
+	for _, old := range s.Files {
+		if old.Name != f.Name {
+			kept = append(kept, old)
+			total += len(old.Data)
+		}
+	}
+	for len(kept) > 0 && total > s.MaxFileStore {
+		total -= len(kept[0].Data)
+		kept = kept[1:]
+	}
+	s.Files = append(kept, f)
+}
+
+// sendFile handles /getfile <name>, replying with the file in the same
+// framing /file uses.
+func (s *Server) sendFile(client *Client, name string) {
+	var file *SharedFile
+	s.FilesLock.Lock()
+	for _, f := range s.Files {
+		if f.Name == name {
+			file = f
+		}
+	}
+	s.FilesLock.Unlock()
+	if file == nil {
+		s.reply(client.Conn, fmt.Sprintf("No file named %q.\n", name))
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "/file %s\n", file.Name)
+	encoded := base64.StdEncoding.EncodeToString(file.Data)
+	for len(encoded) > fileLineWidth {
+		b.WriteString(encoded[:fileLineWidth] + "\n")
+		encoded = encoded[fileLineWidth:]
+	}
+	if encoded != "" {
+		b.WriteString(encoded + "\n")
+	}
+	b.WriteString("/endfile\n")
+	s.reply(client.Conn, b.String())
+}
+
+// broadcastFile handles the admin /sendfile <file name>, which sends every
+// line of a text file in SendFileDir to all clients. Names can't point
+// outside the directory, and sending is disabled unless it is set.
+func (s *Server) broadcastFile(client *Client, name string) {
+	if !s.isAdmin(client) {
+		s.reply(client.Conn, "Only admins can send files.\n")
+		return
+	}
+	if s.SendFileDir == "" {
+		s.reply(client.Conn, "Sending files is disabled on this server.\n")
+		return
+	}
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		s.reply(client.Conn, "Usage: /sendfile <file name>\n")
+		return
+	}
+	path := filepath.Join(s.SendFileDir, name)
+
+	info, err := os.Stat(path)
+	if err == nil && info.Size() > MaxBroadcastFile {
+		s.reply(client.Conn, fmt.Sprintf("%s is too large to send (%d bytes, limit %d).\n", name, info.Size(), MaxBroadcastFile))
+		return
+	}
+	text, err := readTextFile(path)
+	if err != nil {
+		s.reply(client.Conn, fmt.Sprintf("Could not read %s.\n", name))
+		s.logActivity(fmt.Sprintf("Client %s could not send %s: %v", client.Username, name, err))
+		return
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		s.broadcast(s.Format.File(name, strings.TrimSuffix(line, "\r")), "")
+	}
+	s.logActivity(fmt.Sprintf("Client %s sent %s to everyone.", client.Username, name))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFileRoundTrip tests uploading a file and downloading it from another
+// client.
+func TestFileRoundTrip(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	data := bytes.Repeat([]byte("hello, file\n"), 20)
+	encoded := base64.StdEncoding.EncodeToString(data)
+	alice.send("/file notes.txt")
+	alice.expect("Receiving notes.txt")
+	alice.send(encoded[:100])
+	alice.send(encoded[100:])
+	alice.send("/endfile")
+	alice.expect("Stored notes.txt (240 bytes).")
+	bob.expect("Alice shared notes.txt (240 bytes)")
+
+	bob.send("/getfile notes.txt")
+	bob.expect("/file notes.txt")
+	var received strings.Builder
+	for {
+		line := strings.TrimSpace(bob.next())
+		if line == "/endfile" {
+			break
+		}
+		received.WriteString(line)
+	}
+	got, err := base64.StdEncoding.DecodeString(received.String())
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Downloaded %q (%v), want %q", got, err, data)
+	}
+
+	bob.send("/getfile missing.txt")
+	bob.expect(`No file named "missing.txt".`)
+}
+
+// TestFileTooLarge tests that oversized uploads are rejected without their
+// data leaking into the chat.
+func TestFileTooLarge(t *testing.T) {
+	server, addr := startTestServer(t, func(s *Server) {
+		s.MaxFileSize = 16
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("/file big.bin")
+	alice.expect("Receiving big.bin")
+	alice.send(base64.StdEncoding.EncodeToString(make([]byte, 30)))
+	alice.send("AAAA")
+	alice.send("/endfile")
+	alice.expect("File too large (max 16 bytes).")
+	bob.expectNone("AAAA")
+
+	server.FilesLock.Lock()
+	defer server.FilesLock.Unlock()
+	if len(server.Files) != 0 {
+		t.Errorf("Expected no stored files, got %d", len(server.Files))
+	}
+}
+
+// TestFileStoreEviction tests that the oldest files are dropped when the
+// store is full.
+func TestFileStoreEviction(t *testing.T) {
+	server := newTestServer(t, TCP, "0")
+	defer server.Shutdown()
+	server.MaxFileStore = 10
+
+	server.storeFile(&SharedFile{Name: "a", Data: make([]byte, 4)})
+	server.storeFile(&SharedFile{Name: "b", Data: make([]byte, 4)})
+	server.storeFile(&SharedFile{Name: "c", Data: make([]byte, 4)})
+	if len(server.Files) != 2 || server.Files[0].Name != "b" || server.Files[1].Name != "c" {
+		t.Errorf("Unexpected files after eviction: %v", server.Files)
+	}
+}
+
+// TestSendFile tests that /sendfile pushes a file's lines to every client,
+// and refuses non-admins, paths outside the directory and large files.
+func TestSendFile(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "rules.txt"), []byte("1. Be nice\r\n2. No spam\n"), 0666)
+	os.WriteFile(filepath.Join(dir, "big.txt"), bytes.Repeat([]byte("x"), MaxBroadcastFile+1), 0666)
+	_, addr := startTestServer(t, func(s *Server) { s.SendFileDir = dir })
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+
+	bob.send("/sendfile rules.txt")
+	bob.expect("Only admins can send files.")
+	admin.send("/sendfile ../rules.txt")
+	admin.expect("Usage: /sendfile <file name>")
+	admin.send("/sendfile missing.txt")
+	admin.expect("Could not read missing.txt.")
+	admin.send("/sendfile big.txt")
+	admin.expect("big.txt is too large to send")
+
+	admin.send("/sendfile rules.txt")
+	for _, c := range []*testClient{admin, bob} {
+		c.expect("[FILE rules.txt]: 1. Be nice\n")
+		c.expect("[FILE rules.txt]: 2. No spam\n")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Formatter renders chat events as lines for the wire. Every returned line
+// ends in "\n".
+type Formatter interface {
+	// Interactive reports whether clients get the logo and name prompt.
+	Interactive() bool
+	Message(msg Message) string
+	Announcement(msg Message) string
+	Private(msg Message) string
+	Shout(msg Message) string
+	Join(user string) string
+	Leave(user string) string
+	Rename(oldName, newName string) string
+	Info(text string) string
+	// Reply is text sent to one client only, such as a command's answer,
+	// an error or a prompt. text may hold several lines.
+	Reply(text string) string
+	// File is one line of a file pushed to everyone with /sendfile.
+	File(name, line string) string
+	// Dice is the result of a /roll.
+	Dice(user, spec string, rolls []int) string
+}
+
+// NewFormatter returns the formatter for an output protocol name.
+func NewFormatter(name string) (Formatter, error) {
+	switch strings.ToLower(name) {
+	case "human":
+		return HumanFormatter{}, nil
+	case "line":
+		return LineFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown output protocol %q (want human or line)", name)
+}
+
+// oneLine replaces the line breaks in text with spaces, so that text from a
+// client can't end its line early and forge the next one (an [INFO] line,
+// say, or a log entry).
+func oneLine(text string) string {
+	if !strings.ContainsAny(text, "\r\n") {
+		return text
+	}
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(text)
+}
+
+// HumanFormatter is the default format, meant to be read in a terminal.
+type HumanFormatter struct {
+	ShowSeq  bool // prefix messages with their sequence number
+	HideTime bool // leave out message timestamps
+}
+
+func (HumanFormatter) Interactive() bool { return true }
+
+func (f HumanFormatter) Message(msg Message) string {
+	var seq, user string
+	if f.ShowSeq {
+		seq = fmt.Sprintf("[#%d]", msg.Seq)
+	}
+	if msg.ReplyTo != 0 {
+		user = fmt.Sprintf("%s → #%d", msg.Client, msg.ReplyTo)
+	} else {
+		user = msg.Client
+	}
+	return fmt.Sprintf("%s%s[%s]: %s\n", f.timestamp(msg), seq, user, msg.Content)
+}
+
+func (f HumanFormatter) Shout(msg Message) string {
+	return fmt.Sprintf("%s[SHOUT][%s]: %s\n", f.timestamp(msg), msg.Client, msg.Content)
+}
+
+func (HumanFormatter) Announcement(msg Message) string {
+	return fmt.Sprintf("[ANNOUNCEMENT]: %s\n", msg.Content)
+}
+
+func (f HumanFormatter) Private(msg Message) string {
+	return fmt.Sprintf("%s[PM from %s]: %s\n", f.timestamp(msg), msg.Client, msg.Content)
+}
+
+// timestamp returns msg's "[time]" prefix, or "" if times are hidden.
+func (f HumanFormatter) timestamp(msg Message) string {
+	if f.HideTime {
+		return ""
+	}
+	return "[" + msg.Timestamp.Format(TimeFormat) + "]"
+}
+
+func (HumanFormatter) Join(user string) string {
+	return fmt.Sprintf("[INFO]: %s joined the chat\n", user)
+}
+
+func (HumanFormatter) Leave(user string) string {
+	return fmt.Sprintf("[INFO]: %s left the chat\n", user)
+}
+
+func (HumanFormatter) Rename(oldName, newName string) string {
+	return fmt.Sprintf("[INFO]: %s changed their name to %s\n", oldName, newName)
+}
+
+func (HumanFormatter) File(name, line string) string {
+	return fmt.Sprintf("[FILE %s]: %s\n", oneLine(name), oneLine(line))
+}
+
+func (HumanFormatter) Dice(user, spec string, rolls []int) string {
+	parts := make([]string, len(rolls))
+	for i, r := range rolls {
+		parts[i] = strconv.Itoa(r)
+	}
+	return fmt.Sprintf("[DICE]: %s rolled %s → %s=%d\n", user, spec, strings.Join(parts, "+"), sum(rolls))
+}
+
+func (HumanFormatter) Info(text string) string {
+	return fmt.Sprintf("[INFO]: %s\n", oneLine(text))
+}
+
+func (HumanFormatter) Reply(text string) string { return text }
+
+// LineFormatter is a machine-parseable format for bots: one event per line,
+// a keyword followed by space-separated fields, free text last.
+//
+//	MSG <user> <time> <text>
+//	REPLY <user> <time> <parent_seq> <text>
+//	ANNOUNCE <user> <time> <text>
+//	PM <user> <time> <text>
+//	SHOUT <user> <time> <text>
+//	JOIN <user>
+//	LEAVE <user>
+//	NICK <old> <new>
+//	INFO <text>
+//	NOTE <text>
+//	FILE <name> <line>
+//	DICE <user> <spec> <total> <roll>...
+//
+// <time> is in epoch milliseconds unless Time says otherwise; with
+// BotTimeNone the field is left out.
+type LineFormatter struct {
+	// Secret, if set, signs every line: an HMAC-SHA256 of the line, in hex,
+	// is appended as a final space-separated field.
+	Secret []byte
+	Time   BotTime
+}
+
+// BotTime selects how LineFormatter writes message times.
+type BotTime int
+
+const (
+	BotTimeEpochMs BotTime = iota // milliseconds since the Unix epoch
+	BotTimeRFC3339                // RFC 3339 in UTC, with milliseconds
+	BotTimeNone                   // no time field
+)
+
+// ParseBotTime converts a -botts value to a BotTime.
+func ParseBotTime(name string) (BotTime, error) {
+	switch strings.ToLower(name) {
+	case "epochms":
+		return BotTimeEpochMs, nil
+	case "rfc3339":
+		return BotTimeRFC3339, nil
+	case "none":
+		return BotTimeNone, nil
+	}
+	return 0, fmt.Errorf("unknown bot timestamp format %q (want epochms, rfc3339 or none)", name)
+}
+
+func (LineFormatter) Interactive() bool { return false }
+
+func (f LineFormatter) Message(msg Message) string {
+	if msg.ReplyTo != 0 {
+		return f.sign(fmt.Sprintf("REPLY %s %s%d %s", msg.Client, f.timestamp(msg), msg.ReplyTo, msg.Content))
+	}
+	return f.sign(fmt.Sprintf("MSG %s %s%s", msg.Client, f.timestamp(msg), msg.Content))
+}
+
+func (f LineFormatter) Announcement(msg Message) string {
+	return f.sign(fmt.Sprintf("ANNOUNCE %s %s%s", msg.Client, f.timestamp(msg), msg.Content))
+}
+
+func (f LineFormatter) Private(msg Message) string {
+	return f.sign(fmt.Sprintf("PM %s %s%s", msg.Client, f.timestamp(msg), msg.Content))
+}
+
+// timestamp returns msg's time field followed by a space, or "" with
+// BotTimeNone.
+func (f LineFormatter) timestamp(msg Message) string {
+	switch f.Time {
+	case BotTimeRFC3339:
+		return msg.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z07:00") + " "
+	case BotTimeNone:
+		return ""
+	}
+	return strconv.FormatInt(msg.Timestamp.UnixMilli(), 10) + " "
+}
+
+func (f LineFormatter) Shout(msg Message) string {
+	return f.sign(fmt.Sprintf("SHOUT %s %s%s", msg.Client, f.timestamp(msg), msg.Content))
+}
+
+func (f LineFormatter) Join(user string) string {
+	return f.sign(fmt.Sprintf("JOIN %s", user))
+}
+
+func (f LineFormatter) Leave(user string) string {
+	return f.sign(fmt.Sprintf("LEAVE %s", user))
+}
+
+func (f LineFormatter) Rename(oldName, newName string) string {
+	return f.sign(fmt.Sprintf("NICK %s %s", oldName, newName))
+}
+
+func (f LineFormatter) File(name, line string) string {
+	return f.sign(fmt.Sprintf("FILE %s %s", oneLine(name), oneLine(line)))
+}
+
+func (f LineFormatter) Dice(user, spec string, rolls []int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "DICE %s %s %d", user, spec, sum(rolls))
+	for _, r := range rolls {
+		fmt.Fprintf(&b, " %d", r)
+	}
+	return f.sign(b.String())
+}
+
+func (f LineFormatter) Info(text string) string {
+	return f.sign(fmt.Sprintf("INFO %s", oneLine(text)))
+}
+
+// Reply tags each line of text as a NOTE, so that answers to one client
+// can be told apart from room events. A prompt such as "Password: " gets a
+// line of its own.
+func (f LineFormatter) Reply(text string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			b.WriteString(f.sign("NOTE " + line))
+		}
+	}
+	return b.String()
+}
+
+// sum adds up rolls.
+func sum(rolls []int) int {
+	total := 0
+	for _, r := range rolls {
+		total += r
+	}
+	return total
+}
+
+// sign terminates line, first appending its signature if f has a secret.
+func (f LineFormatter) sign(line string) string {
+	if len(f.Secret) == 0 {
+		return line + "\n"
+	}
+	mac := hmac.New(sha256.New, f.Secret)
+	mac.Write([]byte(line))
+	return line + " " + hex.EncodeToString(mac.Sum(nil)) + "\n"
+}
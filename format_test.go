@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLineProtocol tests that line mode skips the logo and prompt and emits
+// machine-parseable events.
+func TestLineProtocol(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Format = LineFormatter{}
+	})
+
+	bot := dialClient(t, addr)
+	bot.send("bot")
+	if line := bot.expect("JOIN"); line != "JOIN bot\n" {
+		t.Fatalf("Expected the join event first, got %q", line)
+	}
+
+	// A space in a name would make the user field ambiguous.
+	other := dialClient(t, addr)
+	other.send("alice smith")
+	other.expect("NOTE Username can't contain spaces.")
+	other.send("alice")
+	bot.expect("JOIN alice")
+	other.send("/name alice smith")
+	other.expect("NOTE Invalid new name.")
+	other.send("hello there")
+	line := bot.expect("MSG")
+	if !regexp.MustCompile(`^MSG alice \d{13} hello there\n$`).MatchString(line) {
+		t.Errorf("Unexpected message line %q", line)
+	}
+
+	other.send("/name bob")
+	bot.expect("NICK alice bob")
+	other.send("/exit")
+	bot.expect("LEAVE bob")
+}
+
+// TestLineFormatter tests each line-mode event format.
+func TestLineFormatter(t *testing.T) {
+	f := LineFormatter{}
+	msg := Message{Timestamp: time.UnixMilli(1700000000123), Client: "alice", Content: "hi all"}
+	tests := []struct{ got, want string }{
+		{f.Message(msg), "MSG alice 1700000000123 hi all\n"},
+		{f.Join("alice"), "JOIN alice\n"},
+		{f.Leave("alice"), "LEAVE alice\n"},
+		{f.Rename("alice", "bob"), "NICK alice bob\n"},
+		{f.Info("slow mode"), "INFO slow mode\n"},
+		{f.File("rules.txt", "be nice"), "FILE rules.txt be nice\n"},
+		{f.Dice("alice", "2d6", []int{4, 5}), "DICE alice 2d6 9 4 5\n"},
+		{f.Reply("Usage: /seen <user>\n"), "NOTE Usage: /seen <user>\n"},
+		{f.Reply("#general: 2 online\n#ops: 1 online\n"), "NOTE #general: 2 online\nNOTE #ops: 1 online\n"},
+		{f.Reply("Password: "), "NOTE Password:\n"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("Got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+// TestLineFormatterTime tests each -botts timestamp format for a fixed
+// instant.
+func TestLineFormatterTime(t *testing.T) {
+	msg := Message{Timestamp: time.UnixMilli(1700000000123), Client: "alice", Content: "hi all", ReplyTo: 4}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"epochms", "REPLY alice 1700000000123 4 hi all\n"},
+		{"rfc3339", "REPLY alice 2023-11-14T22:13:20.123Z 4 hi all\n"},
+		{"none", "REPLY alice 4 hi all\n"},
+	}
+	for _, tt := range tests {
+		botTime, err := ParseBotTime(tt.name)
+		if err != nil {
+			t.Fatalf("ParseBotTime(%q): %v", tt.name, err)
+		}
+		if got := (LineFormatter{Time: botTime}).Message(msg); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if _, err := ParseBotTime("unix"); err == nil {
+		t.Error("Expected an error for an unknown timestamp format")
+	}
+}
+
+// TestNewFormatter tests selecting a formatter by name.
+func TestNewFormatter(t *testing.T) {
+	if f, err := NewFormatter("line"); err != nil || f.Interactive() {
+		t.Errorf("NewFormatter(line) = %v, %v", f, err)
+	}
+	if f, err := NewFormatter("human"); err != nil || !f.Interactive() {
+		t.Errorf("NewFormatter(human) = %v, %v", f, err)
+	}
+	if _, err := NewFormatter("xml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+// TestLineProtocolHMAC tests that a secret adds an HMAC-SHA256 of the line
+// as its last field.
+func TestLineProtocolHMAC(t *testing.T) {
+	f := LineFormatter{Secret: []byte("key")}
+	got := f.Info("The quick brown fox jumps over the lazy dog")
+	want := "INFO The quick brown fox jumps over the lazy dog " +
+		"738481f601b55641774ef512e5b5a85dd2e5e8d2d514d971a8fe9f88bb1e88c7\n"
+	if got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+	if unsigned := (LineFormatter{}).Info("hi"); unsigned != "INFO hi\n" {
+		t.Errorf("Unsigned line is %q", unsigned)
+	}
+}
+
+// TestSignedReplies tests that with a secret, answers to one client, such
+// as the password prompt, /whoami and an unknown command, are tagged and
+// signed like room events.
+func TestSignedReplies(t *testing.T) {
+	secret := []byte("secret")
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Format = LineFormatter{Secret: secret}
+		s.Auth = StaticPasswordAuth{Password: "hunter2"}
+	})
+	verify := func(line string) {
+		t.Helper()
+		line = strings.TrimSuffix(line, "\n")
+		i := strings.LastIndex(line, " ")
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(line[:max(i, 0)]))
+		if i < 0 || line[i+1:] != hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Line %q is not signed", line)
+		}
+	}
+
+	bot := dialClient(t, addr)
+	bot.send("bot")
+	verify(bot.expect("NOTE Password:"))
+	bot.send("hunter2")
+	verify(bot.expect("JOIN bot"))
+	bot.send("/whoami")
+	verify(bot.expect("NOTE You are bot"))
+	bot.send("/nosuch")
+	verify(bot.expect("NOTE Unknown command: /nosuch. Type /help."))
+}
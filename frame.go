@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// In frame mode (-frames) every write to a client is sent as a frame: a
+// flags byte, the payload length as a big-endian uint32, then the payload.
+// Payloads longer than the compression threshold are gzipped and flagged
+// with frameGzip. Client input stays plain lines.
+const (
+	frameRaw  byte = 0
+	frameGzip byte = 1
+
+	// DefaultCompressOver is the payload size above which frames are
+	// compressed.
+	DefaultCompressOver = 1024
+
+	// maxFrameSize bounds the payload ReadFrame accepts.
+	maxFrameSize = 16 * 1024 * 1024
+)
+
+// WriteFrame writes payload to w as one frame, compressing it if it is
+// longer than compressOver bytes.
+func WriteFrame(w io.Writer, payload []byte, compressOver int) error {
+	flags := frameRaw
+	if len(payload) > compressOver {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(payload)
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		flags, payload = frameGzip, buf.Bytes()
+	}
+
+	frame := make([]byte, 5+len(payload))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads one frame from r and returns its decompressed payload.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[0] {
+	case frameRaw:
+		return payload, nil
+	case frameGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return io.ReadAll(io.LimitReader(gz, maxFrameSize))
+	}
+	return nil, fmt.Errorf("unknown frame type %d", header[0])
+}
+
+// frameConn is a connection whose writes are sent as frames.
+type frameConn struct {
+	net.Conn
+	compressOver int
+}
+
+func (c frameConn) Write(p []byte) (int, error) {
+	if err := WriteFrame(c.Conn, p, c.compressOver); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFrameRoundTrip tests that small payloads are sent as-is and large
+// ones are compressed, and that both read back unchanged.
+func TestFrameRoundTrip(t *testing.T) {
+	small := []byte("MSG alice 1700000000000 hi\n")
+	large := []byte("MSG alice 1700000000000 " + strings.Repeat("all work and no play ", 500) + "\n")
+
+	var buf bytes.Buffer
+	for _, payload := range [][]byte{small, large} {
+		if err := WriteFrame(&buf, payload, 1024); err != nil {
+			t.Fatalf("WriteFrame: %v", err)
+		}
+	}
+	if flags := buf.Bytes()[0]; flags != frameRaw {
+		t.Errorf("Small frame flags = %d, want raw", flags)
+	}
+	if flags := buf.Bytes()[5+len(small)]; flags != frameGzip {
+		t.Errorf("Large frame flags = %d, want gzip", flags)
+	}
+	if buf.Len() >= len(small)+len(large) {
+		t.Errorf("Frames take %d bytes, no smaller than the payloads", buf.Len())
+	}
+
+	for _, want := range [][]byte{small, large} {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Read back %d bytes, want %d", len(got), len(want))
+		}
+	}
+}
+
+// TestFramesMode tests that a server in frame mode sends each event as a
+// frame.
+func TestFramesMode(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Format = LineFormatter{}
+		s.Frames = true
+		s.CompressOver = 16
+	})
+	bot := dialClient(t, addr)
+	bot.send("bot")
+	bot.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	payload, err := ReadFrame(bot.reader)
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if string(payload) != "JOIN bot\n" {
+		t.Errorf("First frame is %q", payload)
+	}
+
+	bot.send("/whoami")
+	payload, err = ReadFrame(bot.reader)
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if !strings.HasPrefix(string(payload), "NOTE You are bot") {
+		t.Errorf("Compressed frame is %q", payload)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LoadHistory reads the messages persisted in s.HistoryFile into s.Messages.
+// A missing file is not an error: it is created on the first message.
+func (s *Server) LoadHistory() error {
+	if s.HistoryFile == "" {
+		return nil
+	}
+	messages, err := readHistory(s.HistoryFile)
+	if err != nil {
+		return fmt.Errorf("loading history from %s: %w", s.HistoryFile, err)
+	}
+	lastSeq, err := readSeqFile(seqFile(s.HistoryFile))
+	if err != nil {
+		return fmt.Errorf("loading the last sequence number: %w", err)
+	}
+
+	s.MsgLock.Lock()
+	s.Messages = append(messages, s.Messages...)
+	s.LastSeq = max(s.LastSeq, lastSeq)
+	for _, msg := range messages {
+		s.LastSeq = max(s.LastSeq, msg.Seq)
+		s.historyBytes += len(msg.Content)
+	}
+	s.trimHistory()
+	s.MsgLock.Unlock()
+
+	// Recreate the rooms the history mentions.
+	s.ClientsLock.Lock()
+	for _, msg := range messages {
+		if msg.Room != "" {
+			s.ensureRoom(msg.Room)
+		}
+	}
+	s.ClientsLock.Unlock()
+	return nil
+}
+
+// saveMessage appends msg to the history file, if one is configured. A
+// message whose Seq is already in the file (after an edit or reaction, or
+// marked Deleted) supersedes the earlier record, so the file never has to
+// be rewritten and keeps messages trimmed from s.Messages. Callers hold
+// MsgLock so the file keeps the same order as s.Messages.
+func (s *Server) saveMessage(msg Message) {
+	if s.HistoryFile == "" {
+		return
+	}
+	if err := appendHistory(s.HistoryFile, msg); err != nil {
+		s.logActivity(fmt.Sprintf("Could not save message to history: %v", err))
+	}
+}
+
+// saveLastSeq records LastSeq next to the history file. readHistory drops
+// deleted messages, so after the newest one is deleted this is what lets
+// sequence numbers continue after a restart. Callers hold MsgLock.
+func (s *Server) saveLastSeq() {
+	if s.HistoryFile == "" {
+		return
+	}
+	if err := os.WriteFile(seqFile(s.HistoryFile), []byte(strconv.Itoa(s.LastSeq)+"\n"), 0666); err != nil {
+		s.logActivity(fmt.Sprintf("Could not save the last sequence number: %v", err))
+	}
+}
+
+// seqFile returns the path of the file next to the history that holds the
+// last sequence number.
+func seqFile(historyFile string) string {
+	return historyFile + ".seq"
+}
+
+// readSeqFile returns the sequence number stored in path, or 0 if there is
+// no such file.
+func readSeqFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return seq, nil
+}
+
+// export handles /export <file>, letting an admin snapshot the history in
+// the -history format (gzipped if the name ends in ".gz"). Files are
+// written to ExportDir, and names can't point outside it.
+func (s *Server) export(client *Client, name string) {
+	if !s.isAdmin(client) {
+		s.reply(client.Conn, "Only admins can export the history.\n")
+		return
+	}
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		s.reply(client.Conn, "Usage: /export <file name>\n")
+		return
+	}
+	path := filepath.Join(s.ExportDir, name)
+
+	s.MsgLock.Lock()
+	messages := append([]Message(nil), s.Messages...)
+	s.MsgLock.Unlock()
+
+	if err := writeHistory(path, messages); err != nil {
+		s.reply(client.Conn, fmt.Sprintf("Export failed: %v\n", err))
+		return
+	}
+	s.reply(client.Conn, fmt.Sprintf("Exported %d messages to %s.\n", len(messages), name))
+	s.logActivity(fmt.Sprintf("Client %s exported the history to %s.", client.Username, path))
+}
+
+// getMessage handles /get <seq>, showing the requester a retained message
+// with its timestamp and sequence number, e.g. for quoting it.
+func (s *Server) getMessage(client *Client, args string) {
+	seq, err := strconv.Atoi(strings.TrimPrefix(args, "#"))
+	if err != nil {
+		s.reply(client.Conn, "Usage: /get <seq>\n")
+		return
+	}
+	room := s.clientRoom(client)
+
+	s.MsgLock.Lock()
+	msg := s.visibleMessage(seq, room)
+	var found Message
+	if msg != nil {
+		found = *msg
+	}
+	s.MsgLock.Unlock()
+
+	if msg == nil {
+		s.reply(client.Conn, fmt.Sprintf("No message #%d in history.\n", seq))
+		return
+	}
+	format := s.Format
+	if human, ok := format.(HumanFormatter); ok {
+		human.ShowSeq, human.HideTime = true, false
+		format = human
+	}
+	client.Conn.Write([]byte(s.render(format, found)))
+}
+
+// readHistory decodes one JSON message per line from path. Paths ending in
+// ".gz" are read through gzip.
+func readHistory(path string) ([]Message, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err == io.EOF {
+			return nil, nil // empty file
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var messages []Message
+	index := make(map[int]int) // position in messages of each Seq
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return nil, err
+		}
+		// A later record for a Seq replaces the message or, if
+		// Deleted, removes it. Messages saved before sequence numbers
+		// have none and are all kept.
+		i, seen := index[msg.Seq]
+		switch {
+		case msg.Seq != 0 && seen:
+			messages[i] = msg
+		case msg.Seq != 0:
+			index[msg.Seq] = len(messages)
+			messages = append(messages, msg)
+		case !msg.Deleted:
+			messages = append(messages, msg)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	kept := messages[:0]
+	for _, msg := range messages {
+		if !msg.Deleted {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, nil
+}
+
+// appendHistory appends msg as a JSON line to path.
+//
+// Gzip streams can't be reopened for appending, so for ".gz" paths each
+// message is written as its own gzip member. Concatenated members form a
+// valid multistream gzip file that gzip.Reader (and zcat) read as one, so
+// the file never has to be rewritten and a crash loses at most the message
+// being written. The cost is a weaker compression ratio than a single
+// stream.
+func appendHistory(path string, msg Message) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if !strings.HasSuffix(path, ".gz") {
+		_, err = file.Write(line)
+		return err
+	}
+	gz := gzip.NewWriter(file)
+	if _, err := gz.Write(line); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// writeHistory replaces path with messages, one JSON line each, writing a
+// temporary file first so a failure leaves the old history intact.
+func writeHistory(path string, messages []Message) error {
+	tmp := filepath.Join(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	var w io.Writer = file
+	var gz *gzip.Writer
+	if strings.HasSuffix(path, ".gz") {
+		gz = gzip.NewWriter(file)
+		w = gz
+	}
+	enc := json.NewEncoder(w)
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
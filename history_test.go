@@ -0,0 +1,287 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestGzipHistoryRoundTrip tests that history persisted to a .gz file is
+// restored by a new server.
+func TestGzipHistoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl.gz")
+
+	_, addr := startTestServer(t, func(s *Server) {
+		s.HistoryFile = path
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.send("first")
+	bob.expect("first")
+	alice.send("second")
+	bob.expect("second")
+
+	restarted := newTestServer(t, TCP, "0")
+	defer restarted.Shutdown()
+	restarted.HistoryFile = path
+	if err := restarted.LoadHistory(); err != nil {
+		t.Fatalf("LoadHistory: %v", err)
+	}
+	if len(restarted.Messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(restarted.Messages))
+	}
+	for i, want := range []string{"first", "second"} {
+		if got := restarted.Messages[i]; got.Client != "Alice" || got.Content != want {
+			t.Errorf("Message %d = %+v, want Alice: %s", i, got, want)
+		}
+	}
+}
+
+// TestHistoryMissingFile tests that a missing history file loads as empty.
+func TestHistoryMissingFile(t *testing.T) {
+	for _, name := range []string{"missing.jsonl", "missing.jsonl.gz"} {
+		messages, err := readHistory(filepath.Join(t.TempDir(), name))
+		if err != nil || len(messages) != 0 {
+			t.Errorf("readHistory(%s) = %v, %v; want empty", name, messages, err)
+		}
+	}
+}
+
+// TestHistoryPlainAppend tests appending to an uncompressed history file.
+func TestHistoryPlainAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	msg := Message{Timestamp: time.Unix(1700000000, 0), Client: "Alice", Content: "hi"}
+	for i := 0; i < 3; i++ {
+		if err := appendHistory(path, msg); err != nil {
+			t.Fatalf("appendHistory: %v", err)
+		}
+	}
+	messages, err := readHistory(path)
+	if err != nil {
+		t.Fatalf("readHistory: %v", err)
+	}
+	if len(messages) != 3 || !messages[2].Timestamp.Equal(msg.Timestamp) {
+		t.Errorf("Unexpected history: %+v", messages)
+	}
+}
+
+// TestEditAndDeleteLastMessage tests that /edit and /delete change the
+// sender's latest message in the history and its file.
+func TestEditAndDeleteLastMessage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl.gz")
+	server, addr := startTestServer(t, func(s *Server) {
+		s.HistoryFile = path
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	bob.send("/edit oops")
+	bob.expect("You have no messages to edit.")
+	bob.send("/delete")
+	bob.expect("You have no messages to delete.")
+
+	alice.send("helo")
+	bob.expect("helo")
+	alice.send("/edit hello")
+	bob.expect("[INFO]: Alice edited their last message: hello")
+	alice.send("spam")
+	bob.expect("spam")
+	alice.send("/delete")
+	bob.expect("[INFO]: Alice deleted their last message")
+
+	server.MsgLock.Lock()
+	messages := server.Messages
+	server.MsgLock.Unlock()
+	if len(messages) != 1 || messages[0].Content != "hello" {
+		t.Fatalf("History after edits: %+v", messages)
+	}
+
+	saved, err := readHistory(path)
+	if err != nil {
+		t.Fatalf("readHistory: %v", err)
+	}
+	if len(saved) != 1 || saved[0].Content != "hello" {
+		t.Errorf("History file after edits: %+v", saved)
+	}
+}
+
+// TestEditGated tests that /edit goes through the same read-only, slow
+// mode and duplicate checks as chat, and that /delete is refused while
+// lurking.
+func TestEditGated(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) { s.NoDupes = true })
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+	admin.expect("Bob joined the chat")
+
+	bob.send("helo")
+	admin.expect("[Bob]: helo")
+	bob.send("/edit helo")
+	bob.expect("Duplicate message suppressed.")
+	admin.send("/slowmode 3600")
+	bob.expect("[INFO]: slow mode set to 3600s")
+	bob.send("/edit SPAM")
+	bob.expect("Slow mode: wait")
+
+	bob.send("/lurk")
+	bob.expect("Read-only mode on")
+	bob.send("/edit SPAM")
+	bob.expect("You are in read-only mode.")
+	bob.send("/delete")
+	bob.expect("You are in read-only mode.")
+	admin.expectNone("SPAM")
+}
+
+// TestEditKeepsTrimmedHistory tests that editing or deleting a message
+// with -hmax set leaves the messages trimmed from the replay window in the
+// history file.
+func TestEditKeepsTrimmedHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	_, addr := startTestServer(t, func(s *Server) {
+		s.HistoryFile = path
+		s.HistoryMax = 2
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+
+	for _, text := range []string{"one", "two", "three", "four"} {
+		alice.send(text)
+		bob.expect(text)
+	}
+	alice.send("/edit FOUR")
+	bob.expect("Alice edited their last message: FOUR")
+	bob.send("five")
+	alice.expect("five")
+	bob.send("/delete")
+	alice.expect("Bob deleted their last message")
+
+	saved, err := readHistory(path)
+	if err != nil {
+		t.Fatalf("readHistory: %v", err)
+	}
+	if got := contents(saved); got != "one two three FOUR" {
+		t.Errorf("History file holds %q, want \"one two three FOUR\"", got)
+	}
+}
+
+// TestExport tests that an admin can snapshot the history to a file.
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startTestServer(t, func(s *Server) {
+		s.ExportDir = dir
+	})
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+	admin.send("first")
+	bob.expect("first")
+	bob.send("second")
+	admin.expect("second")
+
+	bob.send("/export export.jsonl")
+	bob.expect("Only admins can export the history.")
+	admin.send("/export ../export.jsonl")
+	admin.expect("Usage: /export <file name>")
+
+	admin.send("/export export.jsonl")
+	admin.expect("Exported 2 messages to export.jsonl.")
+	messages, err := readHistory(filepath.Join(dir, "export.jsonl"))
+	if err != nil {
+		t.Fatalf("readHistory: %v", err)
+	}
+	if len(messages) != 2 || messages[0].Content != "first" || messages[1].Client != "Bob" {
+		t.Errorf("Exported %+v", messages)
+	}
+}
+
+// TestSeqContinuesAfterRestart tests that sequence numbers carry on after a
+// restart even when the newest message was deleted from the history.
+func TestSeqContinuesAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	_, addr := startTestServer(t, func(s *Server) {
+		s.HistoryFile = path
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.send("first")
+	bob.expect("first")
+	alice.send("second")
+	bob.expect("second")
+	alice.send("/delete")
+	bob.expect("Alice deleted their last message")
+
+	restarted := newTestServer(t, TCP, "0")
+	defer restarted.Shutdown()
+	restarted.HistoryFile = path
+	if err := restarted.LoadHistory(); err != nil {
+		t.Fatalf("LoadHistory: %v", err)
+	}
+	if len(restarted.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(restarted.Messages))
+	}
+	if msg := restarted.storeMessage(Message{Client: "Alice", Content: "third"}); msg.Seq != 3 {
+		t.Errorf("Next message got #%d, want #3", msg.Seq)
+	}
+}
+
+// TestHistoryCaps tests that the oldest messages are evicted once the
+// history exceeds either its message count or its byte limit.
+func TestHistoryCaps(t *testing.T) {
+	server := newTestServer(t, TCP, "0")
+	defer server.Shutdown()
+	server.HistoryMax = 3
+	server.HistoryBytes = 25
+
+	for _, content := range []string{"one", "two", "three", "four"} {
+		server.storeMessage(Message{Client: "Alice", Content: content})
+	}
+	if got := contents(server.Messages); got != "two three four" {
+		t.Errorf("After the count cap, history is %q", got)
+	}
+
+	server.storeMessage(Message{Client: "Alice", Content: strings.Repeat("x", 20)})
+	if got := contents(server.Messages); got != "four "+strings.Repeat("x", 20) {
+		t.Errorf("After the byte cap, history is %q", got)
+	}
+	if server.historyBytes != 24 {
+		t.Errorf("Tracked %d bytes, want 24", server.historyBytes)
+	}
+}
+
+// contents joins the contents of messages with spaces.
+func contents(messages []Message) string {
+	var parts []string
+	for _, msg := range messages {
+		parts = append(parts, msg.Content)
+	}
+	return strings.Join(parts, " ")
+}
+
+// TestGetMessage tests that /get shows a retained message with its
+// timestamp and sequence number, and refuses pruned or unknown ones.
+func TestGetMessage(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.HistoryMax = 2
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+
+	for _, text := range []string{"first", "second", "third"} {
+		alice.send(text)
+		bob.expect(text)
+	}
+
+	bob.send("/get 2")
+	if line := bob.next(); !strings.Contains(line, "[#2][Alice]: second") || !strings.HasPrefix(line, "[20") {
+		t.Errorf("Got %q, want message #2 with its timestamp", line)
+	}
+	bob.send("/get 1")
+	bob.expect("No message #1 in history.")
+	bob.send("/get 99")
+	bob.expect("No message #99 in history.")
+	bob.send("/get x")
+	bob.expect("Usage: /get <seq>")
+}
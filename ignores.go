@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	MaxIgnores          = 100  // users one client may ignore
+	MaxSavedIgnoreLists = 1000 // users whose ignore lists are remembered
+)
+
+// savedIgnores is a user's ignore list as remembered between sessions.
+type savedIgnores struct {
+	Names   []string  // folded usernames
+	Updated time.Time // for evicting the stalest list
+}
+
+// saveIgnores remembers client's ignore list under its current name, so
+// that it comes back when the user rejoins. Callers hold ClientsLock, and
+// call writeIgnores once they have released it.
+func (s *Server) saveIgnores(client *Client) {
+	key := foldName(client.Username)
+	if len(client.Ignored) == 0 {
+		delete(s.ignoreLists, key)
+	} else {
+		names := make([]string, 0, len(client.Ignored))
+		for name := range client.Ignored {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		s.ignoreLists[key] = savedIgnores{Names: names, Updated: time.Now()}
+	}
+
+	if len(s.ignoreLists) > MaxSavedIgnoreLists {
+		stalest := key
+		for name, list := range s.ignoreLists {
+			if list.Updated.Before(s.ignoreLists[stalest].Updated) {
+				stalest = name
+			}
+		}
+		delete(s.ignoreLists, stalest)
+	}
+}
+
+// writeIgnores writes the ignore lists to IgnoreFile, if one is set. The
+// lists are copied under ClientsLock but written without it, so saving
+// them doesn't hold up the chat. Each write copies the lists afresh, so
+// the last one to run leaves the newest lists in the file.
+func (s *Server) writeIgnores() {
+	if s.IgnoreFile == "" {
+		return
+	}
+	s.ignoreFileLock.Lock()
+	defer s.ignoreFileLock.Unlock()
+
+	s.ClientsLock.Lock()
+	data, err := json.Marshal(s.ignoreLists)
+	s.ClientsLock.Unlock()
+	if err == nil {
+		err = os.WriteFile(s.IgnoreFile, data, 0666)
+	}
+	if err != nil {
+		s.logActivity(fmt.Sprintf("Could not save ignore lists: %v", err))
+	}
+}
+
+// restoreIgnores gives a joining client the ignore list saved under its
+// name. Callers hold ClientsLock.
+func (s *Server) restoreIgnores(client *Client) {
+	for _, name := range s.ignoreLists[foldName(client.Username)].Names {
+		client.Ignored[name] = true
+	}
+}
+
+// LoadIgnores reads the ignore lists saved in IgnoreFile, if it exists.
+func (s *Server) LoadIgnores() error {
+	if s.IgnoreFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.IgnoreFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lists := make(map[string]savedIgnores)
+	if err := json.Unmarshal(data, &lists); err != nil {
+		return fmt.Errorf("%s: %w", s.IgnoreFile, err)
+	}
+
+	s.ClientsLock.Lock()
+	s.ignoreLists = lists
+	s.ClientsLock.Unlock()
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestIgnoresRestored tests that a user's ignore list comes back when they
+// reconnect under the same name, and survives a restart with IgnoreFile.
+func TestIgnoresRestored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ignores.json")
+	_, addr := startTestServer(t, func(s *Server) { s.IgnoreFile = path })
+	bob := joinClient(t, addr, "Bob")
+	alice := joinClient(t, addr, "Alice")
+	alice.send("/ignore Bob")
+	alice.expect("You are now ignoring Bob.")
+	alice.send("/ignore Mallory")
+	alice.expect("You are now ignoring Mallory.")
+	alice.conn.Close()
+	bob.expect("Alice left the chat")
+
+	alice = joinClient(t, addr, "alice")
+	alice.send("/status")
+	alice.expect("ignoring: 2.")
+	alice.send("/unignore Mallory")
+	alice.expect("You are no longer ignoring Mallory.")
+
+	restarted := newTestServer(t, TCP, "0")
+	restarted.IgnoreFile = path
+	if err := restarted.LoadIgnores(); err != nil {
+		t.Fatalf("LoadIgnores: %v", err)
+	}
+	if names := restarted.ignoreLists["alice"].Names; len(names) != 1 || names[0] != "bob" {
+		t.Errorf("Loaded ignore list %q, want [bob]", names)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultLogKeep is how many rotated log files are kept by default.
+const DefaultLogKeep = 3
+
+// LogFile is the server's activity log. It is opened on first write, and
+// once it would grow past MaxSize it is renamed to Path.1 (shifting older
+// files up to Path.Keep) and a fresh file is started.
+type LogFile struct {
+	Path    string
+	MaxSize int64 // bytes; 0 disables rotation
+	Keep    int   // rotated files to keep
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open opens the log file for appending if it isn't open yet.
+func (l *LogFile) Open() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.open()
+}
+
+func (l *LogFile) open() error {
+	if l.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(l.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return openLogError(l.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Check reports whether the log file could be opened, without leaving
+// anything behind: an existing file is opened and closed again, and for a
+// missing one a probe file is created in its directory and removed.
+func (l *LogFile) Check() error {
+	file, err := os.OpenFile(l.Path, os.O_APPEND|os.O_WRONLY, 0)
+	if err == nil {
+		return file.Close()
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return openLogError(l.Path, err)
+	}
+	probe, err := os.CreateTemp(filepath.Dir(l.Path), ".logcheck-*")
+	if err != nil {
+		return openLogError(l.Path, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// openLogError explains why the log file at path couldn't be opened.
+func openLogError(path string, err error) error {
+	if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+		return fmt.Errorf("log file %s is a directory", path)
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("no permission to write log file %s", path)
+	}
+	return fmt.Errorf("could not open log file %s: %w", path, err)
+}
+
+// WriteString appends s to the log, rotating first if s would take the
+// file past MaxSize.
+func (l *LogFile) WriteString(s string) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(s)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if err := l.open(); err != nil {
+		return 0, err
+	}
+	n, err := l.file.WriteString(s)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file and shifts it to Path.1.
+func (l *LogFile) rotate() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	for i := l.Keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.Path, i), fmt.Sprintf("%s.%d", l.Path, i+1))
+	}
+	if l.Keep < 1 {
+		return os.Remove(l.Path)
+	}
+	return os.Rename(l.Path, l.Path+".1")
+}
+
+// Close closes the log file. A later write reopens it.
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
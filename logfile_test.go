@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLogRotation tests that the log is rotated once it reaches MaxSize and
+// that only Keep rotated files are kept.
+func TestLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.log")
+	logFile := &LogFile{Path: path, MaxSize: 100, Keep: 2}
+	defer logFile.Close()
+
+	line := strings.Repeat("x", 19) + "\n"
+	for i := 0; i < 30; i++ {
+		if _, err := logFile.WriteString(line); err != nil {
+			t.Fatalf("WriteString: %v", err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Expected %s to exist: %v", name, err)
+		}
+		if info.Size() > 100 {
+			t.Errorf("%s is %d bytes, want at most 100", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected no third rotated file, got %v", err)
+	}
+}
+
+// TestLogFileErrors tests that a log path that can't be opened is reported
+// as an error explaining why.
+func TestLogFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := (&LogFile{Path: dir}).Open(); err == nil || !strings.Contains(err.Error(), "is a directory") {
+		t.Errorf("Opening a directory: got %v", err)
+	}
+
+	config, err := ParseConfig([]string{"-logfile", filepath.Join(dir, "missing", "chat.log")})
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	if _, err := config.NewServer(); err == nil || !strings.Contains(err.Error(), "could not open log file") {
+		t.Errorf("Opening a log in a missing directory: got %v", err)
+	}
+
+	// NewServer opens DefaultLogFile in the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, DefaultLogFile), 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	defer os.Chdir(wd)
+	if server, err := NewServer(TCP, "0"); err == nil || !strings.Contains(err.Error(), "is a directory") {
+		t.Errorf("NewServer with a directory as its log: got %v, %v", server, err)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	locked := filepath.Join(dir, "locked")
+	if err := os.Mkdir(locked, 0500); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := (&LogFile{Path: filepath.Join(locked, "chat.log")}).Open(); err == nil || !strings.Contains(err.Error(), "no permission") {
+		t.Errorf("Opening an unwritable log: got %v", err)
+	}
+}
+
+// TestLogChat tests that chat messages, replies and shouts only reach the
+// activity log with LogChat, and only the chat log when ChatLog is set.
+func TestLogChat(t *testing.T) {
+	tests := []struct {
+		name    string
+		logChat bool
+		chatLog bool
+		inLog   bool
+		inChat  bool
+	}{
+		{"disabled", false, false, false, false},
+		{"logchat", true, false, true, false},
+		{"chatlog", false, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			logPath, chatPath := filepath.Join(dir, "server.log"), filepath.Join(dir, "chat.log")
+			server, addr := startTestServer(t, func(s *Server) {
+				s.LogFile = &LogFile{Path: logPath}
+				s.LogChat = tt.logChat
+				if tt.chatLog {
+					s.ChatLog = &LogFile{Path: chatPath}
+				}
+			})
+			alice := joinClient(t, addr, "Alice")
+			bob := joinClient(t, addr, "Bob")
+			alice.expect("Bob joined the chat")
+			alice.send("hello log")
+			bob.expect("hello log")
+			bob.send("/reply 1 got it")
+			alice.expect("got it")
+			bob.send("/shout hey")
+			alice.expect("HEY")
+			server.Shutdown()
+
+			for path, want := range map[string]bool{logPath: tt.inLog, chatPath: tt.inChat} {
+				data, _ := os.ReadFile(path)
+				for _, line := range []string{"[Alice]: hello log", "[Bob → #1]: got it", "[SHOUT][Bob]: HEY"} {
+					if got := strings.Contains(string(data), line); got != want {
+						t.Errorf("%s has %q: %v, want %v", filepath.Base(path), line, got, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// coalescedCategory tracks one category of throttled activity.
+type coalescedCategory struct {
+	since      time.Time // when the category was last logged
+	suppressed int       // events dropped since then
+}
+
+// coalesce reports whether an event of category should be logged. With
+// LogThrottle set, only the first event of a category in each LogThrottle
+// window is; the rest are counted, and summary describes them when the
+// category is next logged.
+func (s *Server) coalesce(category string) (summary string, ok bool) {
+	if s.LogThrottle <= 0 {
+		return "", true
+	}
+	now := time.Now()
+
+	s.ThrottleLock.Lock()
+	defer s.ThrottleLock.Unlock()
+	if s.coalesced == nil {
+		s.coalesced = make(map[string]*coalescedCategory)
+	}
+	c := s.coalesced[category]
+	if c != nil && now.Sub(c.since) < s.LogThrottle {
+		c.suppressed++
+		return "", false
+	}
+	if c != nil && c.suppressed > 0 {
+		summary = c.summary(category, now)
+	}
+	s.coalesced[category] = &coalescedCategory{since: now}
+	return summary, true
+}
+
+// summary describes the events counted in c.
+func (c *coalescedCategory) summary(category string, now time.Time) string {
+	return fmt.Sprintf("%d more %s events in the last %s.", c.suppressed, category, now.Sub(c.since).Round(time.Second))
+}
+
+// logCoalesced is logActivity for high-frequency events such as rejected
+// connections, throttled per category.
+func (s *Server) logCoalesced(category, activity string) {
+	summary, ok := s.coalesce(category)
+	if !ok {
+		return
+	}
+	if summary != "" {
+		s.logActivity(summary)
+	}
+	s.logActivity(activity)
+}
+
+// flushCoalesced logs the counts of events still held back, so that they
+// aren't lost on shutdown.
+func (s *Server) flushCoalesced() {
+	now := time.Now()
+	var summaries []string
+	s.ThrottleLock.Lock()
+	for category, c := range s.coalesced {
+		if c.suppressed > 0 {
+			summaries = append(summaries, c.summary(category, now))
+			c.suppressed = 0
+		}
+	}
+	s.ThrottleLock.Unlock()
+
+	sort.Strings(summaries)
+	for _, summary := range summaries {
+		s.logActivity(summary)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLogThrottle tests that a burst of identical events is logged once,
+// with the rest counted in a summary written on shutdown.
+func TestLogThrottle(t *testing.T) {
+	server, addr := startTestServer(t, func(s *Server) { s.LogThrottle = time.Hour })
+
+	for i := 0; i < 20; i++ {
+		dialClient(t, addr).conn.Close()
+	}
+	accepted := func() int {
+		server.StatsLock.Lock()
+		defer server.StatsLock.Unlock()
+		return server.Stats.Accepted
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for server.goroutines.Load() > 0 || accepted() < 20 {
+		if time.Now().After(deadline) {
+			t.Fatal("The connections were not all handled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Shutdown()
+
+	closes := 0
+	for _, event := range server.recentAudit(MaxAuditEvents) {
+		if strings.Contains(event.Text, "closed before naming") {
+			closes++
+		}
+	}
+	if closes != 1 {
+		t.Errorf("Logged %d early closes, want 1", closes)
+	}
+	if !auditHas(server, "19 more early close events in the last") {
+		t.Error("The suppressed early closes were not summarized")
+	}
+}
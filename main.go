@@ -1,21 +1,54 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/rand/v2"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
-	DefaultPort = "8989"
-	MaxClients  = 10
-	LogFile     = "server.log"
-	LinuxLogo   = `
+	DefaultPort              = "8989"
+	DefaultMaxClients        = 10
+	DefaultNameRetries       = 3
+	DefaultFullMessage       = "Server is full. Try again later."
+	DefaultSlotMessage       = "a slot opened — you're in!"
+	DefaultBufSize           = 1024
+	DefaultMaxNameLen        = 64
+	DefaultMaxDrops          = 100
+	DefaultMaxGoroutines     = 1000
+	DefaultNameTimeout       = 2 * time.Minute
+	MinBufSize               = 64
+	DefaultMaxFileSize       = 64 * 1024
+	DefaultMaxFileStore      = 1024 * 1024
+	DefaultIdleWarning       = 30 * time.Second
+	DefaultReconnectWindow   = 10 * time.Second
+	DefaultReconnectCooldown = 30 * time.Second
+	DefaultLogFile           = "server.log"
+	ShutdownTimeout          = 5 * time.Second
+	MaxEmptyReads            = 10          // zero-byte reads in a row before a connection counts as broken
+	ProbeTimeout             = time.Second // liveness probe on a name clash
+	TimeFormat               = "2006-01-02 15:04:05"
+	ShoutInterval            = time.Minute // minimum time between a client's /shout commands
+	DuplicateWindow          = 10 * time.Second
+	MaxLastSeen              = 1000 // usernames remembered by /seen
+	LinuxLogo                = `
           .--.
          |o_o |
          |:_/ |
@@ -26,6 +59,14 @@ const (
 `
 )
 
+// Exit codes returned by the program.
+const (
+	ExitOK    = 0
+	ExitError = 1 // any other failure, such as an unreadable history file
+	ExitUsage = 2 // invalid flags or configuration
+	ExitBind  = 3 // the port could not be bound
+)
+
 type Protocol string
 
 const (
@@ -33,102 +74,535 @@ const (
 	UDP Protocol = "udp"
 )
 
+// Valid reports whether p is a transport the server supports.
+func (p Protocol) Valid() bool {
+	return p == TCP || p == UDP
+}
+
+// ParseProtocol converts a protocol name such as "tcp" or "UDP" to a
+// Protocol. Names are case-insensitive.
+func ParseProtocol(s string) (Protocol, error) {
+	p := Protocol(strings.ToLower(strings.TrimSpace(s)))
+	if !p.Valid() {
+		return "", fmt.Errorf("unknown protocol %q (want tcp or udp)", s)
+	}
+	return p, nil
+}
+
+// sendCommands are the commands that post something, refused to clients
+// in read-only mode.
+var sendCommands = map[string]bool{
+	"/msg":      true,
+	"/reply":    true,
+	"/announce": true,
+	"/file":     true,
+	"/shout":    true,
+	"/poll":     true,
+	"/vote":     true,
+	"/roll":     true,
+	"/edit":     true,
+	"/delete":   true,
+}
+
+// Reasons a username is refused at the name prompt.
+var (
+	errInvalidName = errors.New("Invalid username.")
+	errNameTaken   = errors.New("Username already taken.")
+	errCommandName = errors.New("Please enter a name, not a command.")
+	errNameTooLong = errors.New("Name too long.")
+	errNameSpaces  = errors.New("Username can't contain spaces.")
+)
+
+// Message kinds other than ordinary chat.
+const (
+	KindAnnouncement = "announcement"
+	KindPrivate      = "private"
+	KindShout        = "shout"
+)
+
 // Message struct holds message details.
 type Message struct {
 	Timestamp time.Time
 	Client    string
 	Content   string
+	Kind      string `json:",omitempty"` // empty for ordinary chat
+	Seq       int    `json:",omitempty"` // position in the history, from 1
+	ReplyTo   int    `json:",omitempty"` // Seq of the message replied to
+	Room      string `json:",omitempty"` // room it was sent in; see visibleIn
+	Color     string `json:",omitempty"` // author's /color choice when it was sent
+	// Reactions lists, for each /react emoji, the folded names of the users
+	// who added it.
+	Reactions map[string][]string `json:",omitempty"`
+	// Deleted marks a history file record removing the message numbered
+	// Seq; see readHistory.
+	Deleted bool `json:",omitempty"`
 }
 
 // Client struct represents connected clients.
 type Client struct {
-	Conn     net.Conn
-	Username string
-	Out      chan string
+	Conn         net.Conn
+	Username     string
+	OriginalName string // name the client joined with, restored by /unname
+	Out          chan string
+	Admin        bool // guarded by ClientsLock; see AdminMode
+	LastPost     time.Time
+	LastMessage  string
+	LastReport   time.Time       // when the client last used /report
+	LastShout    time.Time       // when the client last used /shout
+	Ignored      map[string]bool // folded usernames whose messages are not delivered; guarded by ClientsLock
+	LastActive   time.Time       // guarded by ClientsLock
+	JoinedAt     time.Time
+	ReadOnly     bool   // set by /lurk: receives messages but can't send any; guarded by ClientsLock
+	HideTime     bool   // set by /timestamps off; guarded by ClientsLock
+	Room         string // current room; guarded by ClientsLock
+	Color        string // set by /color; guarded by ClientsLock
+	reader       *bufio.Reader
+	upload       *upload // file being received with /file, if any
+
+	dropped      int          // messages dropped in a row because Out was full; guarded by ClientsLock
+	queued       int          // lines put in Out; guarded by ClientsLock
+	delivered    atomic.Int64 // lines from Out written to Conn
+	disconnected bool         // set once disconnect has run; guarded by ClientsLock
+	eol          *eolConn     // Conn, converting line endings for /eol crlf
+}
+
+// Stats holds the server's runtime counters.
+type Stats struct {
+	TotalMessages int
+	TotalBytes    int
+	PeakClients   int
+	Accepted      int // connections accepted, including those later rejected
+	Rejected      int // connections turned away (server full, bad name, ...)
 }
 
 // Server struct holds the server state.
 type Server struct {
-	Protocol    Protocol
-	Port        string
-	Clients     map[string]*Client
-	Messages    []Message
-	ClientsLock sync.Mutex
-	MsgLock     sync.Mutex
-	LogFile     *os.File
-}
-
-// NewServer creates a new server instance.
-func NewServer(protocol Protocol, port string) *Server {
-	file, err := os.OpenFile(LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		log.Fatalf("Could not open log file: %v", err)
+	Protocol          Protocol
+	Port              string
+	MaxClients        int
+	QueueSize         int           // connections held waiting for a slot when full; 0 rejects them
+	ShowCapacity      bool          // tell new connections how many slots are in use
+	queue             []queuedConn  // waiting connections, first in line first; guarded by ClientsLock
+	BufSize           int           // size of each connection's read buffer
+	Files             []*SharedFile // uploaded with /file, oldest first
+	FilesLock         sync.Mutex
+	MaxFileSize       int               // largest file accepted by /file, in bytes
+	MaxFileStore      int               // total bytes of files kept; the oldest are dropped
+	IdleTimeout       time.Duration     // disconnect clients inactive this long; 0 disables
+	IdleWarning       time.Duration     // warn this long before an idle disconnect; 0 disables
+	MaxMsgLen         int               // longest message in bytes; longer ones are truncated; 0 disables
+	MaxNameLen        int               // longest username, in bytes unless NameLenRunes; enforced while reading the name prompt
+	NameLenRunes      bool              // count MaxNameLen in Unicode code points rather than bytes
+	Aliases           map[string]string // extra command names, e.g. "/w" for "/msg"; see ParseAliases
+	NameTimeout       time.Duration     // time allowed at the name (and password) prompt, however slowly it is typed; 0 disables
+	MaxDrops          int               // consecutive dropped messages before a slow client is evicted
+	BatchInterval     time.Duration     // how long to gather queued lines into a single write; 0 writes each at once
+	MaxGoroutines     int               // client goroutines allowed at once, counting ones still tearing down; 0 disables
+	goroutines        atomic.Int64      // running client goroutines
+	Clients           map[string]*Client
+	folded            map[string]*Client      // Clients keyed by foldName, for command targets
+	rooms             map[string]*Room        // guarded by ClientsLock
+	MaxRooms          int                     // rooms that may exist at once; 0 means no limit
+	RoomIdle          time.Duration           // empty rooms are removed after this long; 0 keeps them
+	LastSeen          map[string]time.Time    // last activity of departed users by folded username; guarded by ClientsLock
+	ignoreLists       map[string]savedIgnores // ignore lists by folded username, kept across sessions; guarded by ClientsLock
+	ignoreFileLock    sync.Mutex              // serializes writes to IgnoreFile; taken before ClientsLock
+	IgnoreFile        string                  // where ignore lists are saved; empty keeps them in memory only
+	leftAtSeq         map[string]int          // LastSeq when each user in LastSeen left, by folded username; guarded by ClientsLock
+	MissedNotice      bool                    // tell returning users how many messages they missed
+	Messages          []Message
+	LastSeq           int // Seq of the newest stored message; guarded by MsgLock
+	HistoryMax        int // messages kept for replay; 0 means no limit
+	HistoryBytes      int // total content bytes kept for replay; 0 means no limit
+	historyBytes      int // content bytes in Messages; guarded by MsgLock
+	Stats             Stats
+	ClientsLock       sync.Mutex
+	MsgLock           sync.Mutex
+	StatsLock         sync.Mutex
+	ModeLock          sync.Mutex
+	PollLock          sync.Mutex
+	poll              *Poll         // the running poll, if any; guarded by PollLock
+	PollDuration      time.Duration // how long polls stay open
+	PollAdminOnly     bool          // only admins may start polls
+	AdminMode         AdminMode     // who administers the server
+	AdminPassword     string        // grants admin with /admin in AdminPassword mode
+	KeepAdmin         bool          // refuse to /demote the last admin
+	SlowMode          time.Duration // minimum interval between non-admin posts
+	Locked            bool          // set by /lockdown: only admins may post; guarded by ModeLock
+	LogFile           *LogFile
+	LogChat           bool     // also write chat messages to LogFile
+	ChatLog           *LogFile // if set, chat messages are written here instead of LogFile
+	HistoryFile       string
+	ExportDir         string // where /export writes files
+	SendFileDir       string // where /sendfile reads files from; empty disables it
+	NameRetries       int
+	AllowGuest        bool           // give clients that enter no name a Guest-NNNN name
+	Location          *time.Location // time zone used to format timestamps
+	Format            Formatter
+	Frames            bool          // send output as frames (see frame.go) instead of plain text
+	ProxyProtocol     bool          // expect a PROXY protocol v1 header on each connection
+	CompressOver      int           // frame payloads longer than this are gzipped
+	Auth              Authenticator // checks each client before it joins
+	WhoisRedacted     bool          // let non-admins use /whois, without addresses and traffic
+	NoDupes           bool          // drop a client's message if it repeats their previous one
+	Confirm           bool          // send authors a receipt for each message
+	Colors            bool          // show usernames in color in human output
+	Fanout            int           // workers rendering each broadcast; 0 or 1 renders them under ClientsLock
+	AllowHalfClose    bool          // keep delivering to clients that closed their sending side
+	WSAddr            string        // address of the WebSocket gateway; empty disables it
+	FullMessage       string        // sent to connections rejected because the server is full
+	SlotMessage       string        // info line sent to a queued connection as it leaves the queue; empty sends none
+	Presence          time.Duration // interval between "N users online" broadcasts; 0 disables
+	Tips              []string      // broadcast in turn every TipInterval
+	TipInterval       time.Duration
+	MOTDFile          string       // message of the day shown to new clients
+	LogoFile          string       // replaces LinuxLogo when set
+	NoLogo            bool         // send no logo at all
+	WSLogoFile        string       // replaces the logo for WebSocket clients when set; an empty file sends none
+	BanFile           string       // IP addresses refused on connect
+	AllowFile         string       // if it lists any IP addresses, only those may connect
+	AllowCIDRs        []*net.IPNet // if set, only these networks may connect
+	DenyCIDRs         []*net.IPNet // networks refused on connect, checked before AllowCIDRs
+	ReconnectLimit    int          // connections allowed per address within ReconnectWindow; 0 disables
+	ReconnectWindow   time.Duration
+	ReconnectCooldown time.Duration          // how long an address over the limit is refused
+	attempts          map[string][]time.Time // recent connection times per address; guarded by ClientsLock
+	penalties         map[string]time.Time   // addresses refused until the given time; guarded by ClientsLock
+	ReloadLock        sync.Mutex             // guards the contents loaded from the files above
+	AuditLock         sync.Mutex
+	LogThrottle       time.Duration // log each high-frequency category at most once per interval; 0 disables
+	ThrottleLock      sync.Mutex
+	coalesced         map[string]*coalescedCategory // guarded by ThrottleLock
+	audit             []AuditEvent                  // ring buffer of recent activity, for /audit
+	auditNext         int                           // index in audit of the next event to write
+	CmdLogLock        sync.Mutex
+	cmdLog            []CommandEvent // ring buffer of recent commands, for /cmdlog
+	cmdLogNext        int            // index in cmdLog of the next command to write
+	TopicLock         sync.Mutex
+	topics            []Topic // topics set with /topic, oldest first; the last is current
+	motd              string
+	logo              string
+	wsLogo            string
+	banned            map[string]bool
+	allowed           map[string]bool
+	listener          net.Listener
+	wsListener        net.Listener          // WebSocket gateway listener, if any
+	conns             map[net.Conn]struct{} // open connections, named or not
+	closed            bool                  // set once Shutdown begins
+	done              chan struct{}         // closed by Shutdown to stop background tasks
+	wg                sync.WaitGroup        // tracks per-client goroutines
+}
+
+// NewServer creates a new server instance for protocol on port and opens
+// its log file, DefaultLogFile. If the log can't be opened it returns an
+// error saying why, rather than failing on the first write.
+func NewServer(protocol Protocol, port string) (*Server, error) {
+	s := NewServerWithOptions(WithProtocol(protocol), WithPort(port))
+	if err := s.LogFile.Open(); err != nil {
+		return nil, err
 	}
+	return s, nil
+}
 
-	return &Server{
-		Protocol: protocol,
-		Port:     port,
-		Clients:  make(map[string]*Client),
-		Messages: []Message{},
-		LogFile:  file,
+// NewServerWithOptions creates a server with the defaults, a TCP server on
+// DefaultPort, changed by opts. It can't fail: the log file is only opened
+// on first use, so embedders that want to know up front whether it is
+// writable call LogFile.Open, as NewServer and Config.NewServer do.
+func NewServerWithOptions(opts ...Option) *Server {
+	s := &Server{
+		Protocol:          TCP,
+		Port:              DefaultPort,
+		MaxClients:        DefaultMaxClients,
+		BufSize:           DefaultBufSize,
+		MaxNameLen:        DefaultMaxNameLen,
+		MaxDrops:          DefaultMaxDrops,
+		MaxGoroutines:     DefaultMaxGoroutines,
+		NameTimeout:       DefaultNameTimeout,
+		MaxFileSize:       DefaultMaxFileSize,
+		MaxFileStore:      DefaultMaxFileStore,
+		IdleWarning:       DefaultIdleWarning,
+		Clients:           make(map[string]*Client),
+		folded:            make(map[string]*Client),
+		rooms:             map[string]*Room{DefaultRoom: {Name: DefaultRoom, Created: time.Now()}},
+		MaxRooms:          DefaultMaxRooms,
+		conns:             make(map[net.Conn]struct{}),
+		attempts:          make(map[string][]time.Time),
+		penalties:         make(map[string]time.Time),
+		ReconnectWindow:   DefaultReconnectWindow,
+		ReconnectCooldown: DefaultReconnectCooldown,
+		LastSeen:          make(map[string]time.Time),
+		ignoreLists:       make(map[string]savedIgnores),
+		leftAtSeq:         make(map[string]int),
+		done:              make(chan struct{}),
+		Messages:          []Message{},
+		LogFile:           &LogFile{Path: DefaultLogFile},
+		NameRetries:       DefaultNameRetries,
+		Location:          time.Local,
+		Format:            HumanFormatter{},
+		AdminMode:         AdminFirst,
+		KeepAdmin:         true,
+		Auth:              NoAuth{},
+		CompressOver:      DefaultCompressOver,
+		FullMessage:       DefaultFullMessage,
+		SlotMessage:       DefaultSlotMessage,
+		PollDuration:      DefaultPollDuration,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
-// Start initiates the server based on the protocol (TCP or UDP).
-func (s *Server) Start() {
+// Start initiates the server based on the protocol (TCP or UDP). It
+// returns an error if the port can't be bound, and nil once the server
+// stops.
+func (s *Server) Start() error {
 	if s.Protocol == UDP {
-		s.startUDP()
-	} else {
-		s.startTCP()
+		return s.startUDP()
 	}
+	return s.startTCP()
 }
 
 // startTCP starts a TCP server and handles connections.
-func (s *Server) startTCP() {
+func (s *Server) startTCP() error {
 	listener, err := net.Listen(string(TCP), ":"+s.Port)
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		return err
 	}
-	defer listener.Close()
 	log.Printf("Listening on port %s with TCP", s.Port)
-
-	for {
-		if len(s.Clients) >= MaxClients {
-			log.Println("Max clients connected. Rejecting new connection.")
-			conn, err := listener.Accept()
-			if err == nil {
-				conn.Write([]byte("Server is full. Try again later.\n"))
-				conn.Close()
-			}
-			continue
+	if s.WSAddr != "" {
+		wsListener, err := net.Listen(string(TCP), s.WSAddr)
+		if err != nil {
+			listener.Close()
+			return err
 		}
+		log.Printf("WebSocket gateway listening on %s", s.WSAddr)
+		go s.serveWebSocket(wsListener)
+	}
+	s.serveTCP(listener)
+	return nil
+}
 
+// serveTCP accepts connections on listener until it is closed.
+func (s *Server) serveTCP(listener net.Listener) {
+	s.ClientsLock.Lock()
+	s.listener = listener
+	s.ClientsLock.Unlock()
+	defer listener.Close()
+
+	if s.Presence > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.announcePresence(s.Presence)
+		}()
+	}
+	if s.RoomIdle > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.cleanRooms()
+		}()
+	}
+	if len(s.Tips) > 0 && s.TipInterval > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.rotateTips(s.TipInterval)
+		}()
+	}
+
+	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
 
-		go s.handleClient(conn)
+		if s.busy(conn) {
+			continue
+		}
+		if !s.track(conn) {
+			return
+		}
+		s.goroutines.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.goroutines.Add(-1)
+			s.admit(conn)
+		}()
+	}
+}
+
+// busy rejects conn and reports true if MaxGoroutines client goroutines
+// are already running. Unlike MaxClients, this counts connections at the
+// name prompt and in the queue, and clients whose goroutines haven't
+// finished tearing down.
+func (s *Server) busy(conn net.Conn) bool {
+	if s.MaxGoroutines <= 0 || s.goroutines.Load() < int64(s.MaxGoroutines) {
+		return false
+	}
+	s.rejectConn(conn, "server busy")
+	return true
+}
+
+// track counts a newly accepted connection and registers it so Shutdown can
+// close it. It returns false, closing conn, if the server is shutting down;
+// otherwise the caller serves conn and then calls s.wg.Done.
+func (s *Server) track(conn net.Conn) bool {
+	s.StatsLock.Lock()
+	s.Stats.Accepted++
+	s.StatsLock.Unlock()
+
+	s.ClientsLock.Lock()
+	defer s.ClientsLock.Unlock()
+	if s.closed {
+		// Accepted while Shutdown was closing the listener.
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// admit decides what happens to a newly accepted connection: it is
+// rejected, queued, or served. It runs in the connection's own goroutine
+// so that reading a PROXY header can't hold up the accept loop.
+func (s *Server) admit(raw net.Conn) {
+	conn, err := s.prepareConn(raw)
+	if err != nil {
+		s.rejectConn(raw, err.Error())
+		s.untrack(raw)
+		return
+	}
+	s.screen(raw, conn)
+}
+
+// screen turns conn away if its address or the server's capacity says so,
+// and otherwise queues or serves it. raw is the tracked connection conn
+// wraps.
+func (s *Server) screen(raw, conn net.Conn) {
+	s.ClientsLock.Lock()
+	delete(s.conns, raw)
+	s.conns[conn] = struct{}{}
+	reject := func(notice, reason string) {
+		s.ClientsLock.Unlock()
+		if notice != "" {
+			s.reply(conn, notice+"\n")
+		}
+		s.rejectConn(conn, reason)
+		s.untrack(conn)
+	}
+	if s.throttled(conn, time.Now()) {
+		reject("Too many reconnect attempts; slow down.", "reconnect backoff")
+		return
+	}
+	if !s.permittedNetwork(conn) {
+		reject("Connection not permitted from your network.", "network not permitted")
+		return
+	}
+	if reason := s.admitted(conn); reason != "" {
+		reject("", reason)
+		return
+	}
+	if len(s.Clients) >= s.MaxClients || len(s.queue) > 0 {
+		if len(s.queue) < s.QueueSize {
+			q := s.enqueueConn(conn)
+			position := len(s.queue)
+			s.ClientsLock.Unlock()
+			s.logActivity(fmt.Sprintf("Queued connection from %s (#%d).", conn.RemoteAddr(), position))
+			s.waitInQueue(q)
+			return
+		}
+		reject(s.FullMessage, "server full")
+		return
+	}
+	s.ClientsLock.Unlock()
+	s.runClient(conn)
+}
+
+// prepareConn reads the PROXY header, if expected, and wraps conn for
+// framing and traffic counting.
+func (s *Server) prepareConn(conn net.Conn) (net.Conn, error) {
+	if s.ProxyProtocol {
+		addr, err := readProxyHeader(conn)
+		if err != nil {
+			log.Printf("Bad PROXY header from %s: %v", conn.RemoteAddr(), err)
+			return nil, errors.New("invalid PROXY header")
+		}
+		if addr != nil {
+			conn = proxiedConn{conn, addr}
+		}
+	}
+	if s.Frames {
+		conn = frameConn{conn, s.CompressOver}
+	}
+	return &countingConn{Conn: conn}, nil
+}
+
+// runClient runs the join flow for conn. When it ends, the slot it held
+// goes to the first queued connection.
+func (s *Server) runClient(conn net.Conn) {
+	s.handleClient(conn)
+
+	s.ClientsLock.Lock()
+	delete(s.conns, conn)
+	s.promoteQueued()
+	s.ClientsLock.Unlock()
+}
+
+// untrack forgets a connection that was closed without being served.
+func (s *Server) untrack(conn net.Conn) {
+	s.ClientsLock.Lock()
+	delete(s.conns, conn)
+	s.ClientsLock.Unlock()
+}
+
+// announcePresence broadcasts the number of online users every interval,
+// skipping ticks where it hasn't changed, until the server shuts down.
+func (s *Server) announcePresence(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := -1
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.ClientsLock.Lock()
+		count := len(s.Clients)
+		s.ClientsLock.Unlock()
+		if count == last {
+			continue
+		}
+		last = count
+		s.broadcast(s.Format.Info(fmt.Sprintf("%d users online", count)), "INFO")
 	}
 }
 
 // startUDP starts a UDP server and handles incoming messages.
-func (s *Server) startUDP() {
+func (s *Server) startUDP() error {
 	udpAddr, err := net.ResolveUDPAddr(string(UDP), ":"+s.Port)
 	if err != nil {
-		log.Fatalf("Error resolving UDP address: %v", err)
+		return err
 	}
 
 	conn, err := net.ListenUDP(string(UDP), udpAddr)
 	if err != nil {
-		log.Fatalf("Error starting UDP server: %v", err)
+		return err
 	}
 	defer conn.Close()
 
 	log.Printf("Listening on port %s with UDP", s.Port)
 
-	buf := make([]byte, 1024)
+	buf := make([]byte, s.BufSize)
 	for {
 		n, addr, err := conn.ReadFromUDP(buf)
 		if err != nil {
@@ -144,172 +618,1575 @@ func (s *Server) startUDP() {
 func (s *Server) handleClient(conn net.Conn) {
 	defer conn.Close()
 
-	conn.Write([]byte(LinuxLogo))
-	conn.Write([]byte("Enter your name: "))
+	// Nothing is registered until the client has a name, so a failed
+	// write during the handshake only needs to drop the connection.
+	if logo := s.logoFor(conn); logo != "" && s.Format.Interactive() {
+		if _, err := conn.Write([]byte(logo)); err != nil {
+			s.logCoalesced("early close", fmt.Sprintf("Connection from %s closed before naming.", conn.RemoteAddr()))
+			return
+		}
+	}
 
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
-	if err != nil {
-		return
+	if s.ShowCapacity {
+		s.ClientsLock.Lock()
+		inUse := len(s.Clients)
+		s.ClientsLock.Unlock()
+		conn.Write([]byte(s.Format.Info(fmt.Sprintf("%d/%d slots in use", inUse, s.MaxClients))))
 	}
 
-	username := strings.TrimSpace(string(buf[:n]))
-	if username == "" {
-		conn.Write([]byte("Invalid username. Disconnecting...\n"))
+	reader := bufio.NewReaderSize(emptyReadGuard{&telnetFilter{r: conn}}, s.BufSize)
+	client := s.promptForName(conn, reader)
+	if client == nil {
 		return
 	}
+	client.reader = reader
+	username := client.Username
 
-	client := &Client{
-		Conn:     conn,
-		Username: username,
-		Out:      make(chan string, 100), // Increased buffer size even further
-	}
+	s.logActivity(fmt.Sprintf("Client %s joined.", username))
+	s.broadcast(s.Format.Join(username), "INFO")
+	s.sendMOTD(client)
+	s.sendTopic(client)
 
-	s.ClientsLock.Lock()
-	if _, exists := s.Clients[username]; exists {
+	s.replayHistory(client, DefaultRoom)
+
+	if s.MissedNotice {
+		s.ClientsLock.Lock()
+		leftAt, returning := s.leftAtSeq[foldName(username)]
 		s.ClientsLock.Unlock()
-		conn.Write([]byte("Username already taken. Disconnecting...\n"))
+		if returning {
+			s.sendMissed(client, leftAt)
+		}
+	}
+
+	sent := make(chan struct{})
+	s.wg.Add(1)
+	s.goroutines.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.goroutines.Add(-1)
+		defer close(sent)
+		s.sendMessagesToClient(client)
+	}()
+	reason := s.receiveMessagesFromClient(client)
+	if reason == reasonHalfClosed {
+		// The sender goroutine disconnects the client once a write fails,
+		// and stops when anything else disconnects it.
+		s.logActivity(fmt.Sprintf("Client %s stopped sending; still delivering to it.", username))
+		<-sent
 		return
 	}
-	s.Clients[username] = client
-	s.ClientsLock.Unlock()
+	s.disconnect(client, reason)
+}
 
-	s.logActivity(fmt.Sprintf("Client %s joined.", username))
-	s.broadcast(fmt.Sprintf("[INFO]: %s joined the chat\n", username), "INFO")
+// reasonHalfClosed is returned by receiveMessagesFromClient when the client
+// closed its sending side and AllowHalfClose keeps it connected.
+const reasonHalfClosed = "half-closed"
 
+// disconnect tells client why it is being disconnected, removes it from the
+// chat and closes its connection. Only the first call for a client has any
+// effect, so any goroutine may use it.
+func (s *Server) disconnect(client *Client, reason string) {
 	s.MsgLock.Lock()
-	for _, msg := range s.Messages {
-		conn.Write([]byte(fmt.Sprintf("[%s][%s]: %s\n", msg.Timestamp.Format("2006-01-02 15:04:05"), msg.Client, msg.Content)))
-	}
+	lastSeq := s.LastSeq
 	s.MsgLock.Unlock()
 
-	go s.sendMessagesToClient(client)
-	s.receiveMessagesFromClient(client)
-
+	// Once the client is out of the map no broadcast can reach it, so its
+	// Out channel can be closed, which stops the sender goroutine.
 	s.ClientsLock.Lock()
+	if client.disconnected {
+		s.ClientsLock.Unlock()
+		return
+	}
+	client.disconnected = true
+	username := client.Username
 	delete(s.Clients, username)
+	delete(s.folded, foldName(username))
+	s.recordSeen(username, client.LastActive)
+	s.leftAtSeq[foldName(username)] = lastSeq
+	close(client.Out)
+	var promoted *Client
+	if client.Admin {
+		promoted = s.promoteOldest()
+	}
 	s.ClientsLock.Unlock()
 
-	s.broadcast(fmt.Sprintf("[INFO]: %s left the chat\n", username), "INFO")
-	s.logActivity(fmt.Sprintf("Client %s left.", username))
+	client.Conn.Write([]byte(s.Format.Info("disconnected: " + reason)))
+	client.Conn.Close()
+	if promoted != nil {
+		s.announceAdmin(promoted.Username)
+	}
+
+	s.broadcast(s.Format.Leave(username), "INFO")
+	s.logActivity(fmt.Sprintf("Client %s left (%s).", username, reason))
 }
 
-// sendMessagesToClient sends messages to a specific client.
-func (s *Server) sendMessagesToClient(client *Client) {
-	for msg := range client.Out {
-		_, err := client.Conn.Write([]byte(msg))
+// rejectConn tells a connection that never joined why it is being dropped
+// and closes it.
+func (s *Server) rejectConn(conn net.Conn, reason string) {
+	s.StatsLock.Lock()
+	s.Stats.Rejected++
+	s.StatsLock.Unlock()
+
+	conn.Write([]byte(s.Format.Info("disconnected: " + reason)))
+	conn.Close()
+	s.logCoalesced("rejected connection", fmt.Sprintf("Rejected connection from %s (%s).", conn.RemoteAddr(), reason))
+}
+
+// promptForName asks for a username until the client picks a valid, free one
+// or runs out of retries. It returns the registered client, or nil if the
+// connection should be dropped.
+func (s *Server) promptForName(conn net.Conn, reader *bufio.Reader) *Client {
+	if s.NameTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.NameTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	for attempt := 0; ; attempt++ {
+		if s.Format.Interactive() {
+			if err := s.reply(conn, "Enter your name: "); err != nil {
+				s.logCoalesced("early close", fmt.Sprintf("Connection from %s closed before naming.", conn.RemoteAddr()))
+				return nil
+			}
+		}
+		line, err := readBoundedLine(reader, s.nameReadLimit())
+		if err == nil && s.nameTooLong(strings.TrimSpace(line)) {
+			err = errNameTooLong
+		}
+		if err == errNameTooLong {
+			s.reply(conn, err.Error()+"\n")
+			s.rejectConn(conn, "name too long")
+			return nil
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			s.rejectConn(conn, "name timeout")
+			return nil
+		}
 		if err != nil {
-			return
+			// Nothing was registered, so there is no leave to announce.
+			s.logCoalesced("early close", fmt.Sprintf("Connection from %s closed before naming.", conn.RemoteAddr()))
+			return nil
+		}
+
+		username := strings.TrimSpace(line)
+		guest := username == "" && s.AllowGuest
+		if guest {
+			username = s.guestName()
+		}
+		if validateName(username) == nil {
+			ok, err := s.Auth.Authenticate(username, bufferedConn{conn, reader, s.Format})
+			if err == errPasswordTooLong {
+				s.reply(conn, err.Error()+"\n")
+				s.rejectConn(conn, "password too long")
+				return nil
+			}
+			if err != nil {
+				s.rejectConn(conn, "authentication error")
+				return nil
+			}
+			if !ok {
+				s.reply(conn, "Authentication failed.\n")
+				s.rejectConn(conn, "authentication failed")
+				return nil
+			}
 		}
+
+		client, err := s.addClient(conn, username)
+		if err == nil {
+			if guest {
+				s.reply(conn, fmt.Sprintf("You joined as %s.\n", username))
+			}
+			return client
+		}
+		if err := s.reply(conn, err.Error()+"\n"); err != nil {
+			return nil
+		}
+		if attempt >= s.NameRetries {
+			s.reply(conn, "Too many invalid attempts.\n")
+			s.rejectConn(conn, "too many invalid attempts")
+			return nil
+		}
+	}
+}
+
+// nameTooLong reports whether name is over MaxNameLen, counted in bytes
+// or, with NameLenRunes, in code points.
+func (s *Server) nameTooLong(name string) bool {
+	if s.NameLenRunes {
+		return utf8.RuneCountInString(name) > s.MaxNameLen
 	}
+	return len(name) > s.MaxNameLen
 }
 
-// receiveMessagesFromClient listens for incoming messages from a client, including the name change command.
-func (s *Server) receiveMessagesFromClient(client *Client) {
-	buf := make([]byte, 1024)
+// nameReadLimit is how many bytes the name prompt reads before giving up:
+// MaxNameLen, or enough for MaxNameLen code points with NameLenRunes.
+func (s *Server) nameReadLimit() int {
+	if s.NameLenRunes {
+		return s.MaxNameLen * utf8.UTFMax
+	}
+	return s.MaxNameLen
+}
+
+// guestName returns a free name of the form Guest-1234, for a client that
+// left the name prompt empty.
+func (s *Server) guestName() string {
+	s.ClientsLock.Lock()
+	defer s.ClientsLock.Unlock()
 	for {
-		n, err := client.Conn.Read(buf)
-		if err != nil {
-			return
+		name := fmt.Sprintf("Guest-%04d", rand.IntN(10000))
+		if s.findClient(name) == nil {
+			return name
 		}
+	}
+}
 
-		message := strings.TrimSpace(string(buf[:n]))
-
-		// Handle name change command
-		if strings.HasPrefix(message, "/name ") {
-			newName := strings.TrimSpace(strings.TrimPrefix(message, "/name "))
-			if newName == "" {
-				client.Conn.Write([]byte("Invalid new name.\n"))
-				continue
-			}
+// alive probes client's connection with a notice, reporting whether the
+// write went through within ProbeTimeout.
+func (s *Server) alive(client *Client) bool {
+	client.Conn.SetWriteDeadline(time.Now().Add(ProbeTimeout))
+	defer client.Conn.SetWriteDeadline(time.Time{})
+	_, err := client.Conn.Write([]byte(s.Format.Info("someone tried to join with your name")))
+	return err == nil
+}
 
-			// Ensure the new name isn't already taken
-			s.ClientsLock.Lock()
-			if _, exists := s.Clients[newName]; exists {
-				client.Conn.Write([]byte("This name is already taken.\n"))
-				s.ClientsLock.Unlock()
-				continue
-			}
+// validateName reports why username can't be used, or nil if it can.
+// Names starting with '/' are refused so a command typed at the name
+// prompt, such as /exit, doesn't become a username. Control characters,
+// such as a carriage return or the escape starting an ANSI sequence, are
+// refused so a name can't rewrite the lines it appears in, and so are
+// spaces, which would split the user field of line-protocol events.
+func validateName(username string) error {
+	switch {
+	case username == "", strings.IndexFunc(username, unicode.IsControl) >= 0:
+		return errInvalidName
+	case strings.IndexFunc(username, unicode.IsSpace) >= 0:
+		return errNameSpaces
+	case strings.HasPrefix(username, "/"):
+		return errCommandName
+	}
+	return nil
+}
 
-			// Broadcast the name change
-			oldName := client.Username
-			delete(s.Clients, client.Username) // Remove the old name
-			client.Username = newName          // Update the name
-			s.Clients[newName] = client        // Add the new name
+// addClient registers a client named username on conn.
+func (s *Server) addClient(conn net.Conn, username string) (*Client, error) {
+	if err := validateName(username); err != nil {
+		return nil, err
+	}
 
-			s.ClientsLock.Unlock()
+	eol := &eolConn{Conn: conn}
+	client := &Client{
+		Conn:         eol,
+		eol:          eol,
+		Username:     username,
+		OriginalName: username,
+		LastActive:   time.Now(),
+		JoinedAt:     time.Now(),
+		Room:         DefaultRoom,
+		Out:          make(chan string, 100), // Increased buffer size even further
+		Ignored:      make(map[string]bool),
+	}
 
-			// Notify others of the name change
-			s.broadcast(fmt.Sprintf("[INFO]: %s changed their name to %s\n", oldName, newName), "INFO")
-			s.logActivity(fmt.Sprintf("Client %s changed their name to %s", oldName, newName))
+	s.ClientsLock.Lock()
+	if existing := s.findClient(username); existing != nil {
+		s.ClientsLock.Unlock()
+		// The holder may have dropped without the server noticing yet; if
+		// so, the name is freed for the reconnecting client.
+		if s.alive(existing) {
+			return nil, errNameTaken
+		}
+		s.disconnect(existing, "connection lost")
 
-			continue
+		s.ClientsLock.Lock()
+		if s.findClient(username) != nil {
+			s.ClientsLock.Unlock()
+			return nil, errNameTaken
 		}
+	}
+	// The first client on an empty server administers it.
+	client.Admin = s.AdminMode == AdminFirst && len(s.Clients) == 0
+	s.Clients[username] = client
+	s.folded[foldName(username)] = client
+	s.restoreIgnores(client)
+	count := len(s.Clients)
+	s.ClientsLock.Unlock()
 
-		if message == "/exit" {
+	s.StatsLock.Lock()
+	if count > s.Stats.PeakClients {
+		s.Stats.PeakClients = count
+	}
+	s.StatsLock.Unlock()
+	return client, nil
+}
+
+// sendMessagesToClient sends messages to a specific client. A failed write
+// means the client is gone, so it is disconnected at once rather than
+// waiting for the read side to notice.
+func (s *Server) sendMessagesToClient(client *Client) {
+	if s.BatchInterval > 0 {
+		s.sendBatched(client)
+		return
+	}
+	for msg := range client.Out {
+		_, err := client.Conn.Write([]byte(msg))
+		if err != nil {
+			s.disconnect(client, "write failed")
 			return
 		}
+		client.delivered.Add(1)
+	}
+}
 
-		timestamp := time.Now()
-		msg := Message{Timestamp: timestamp, Client: client.Username, Content: message}
-		s.MsgLock.Lock()
-		s.Messages = append(s.Messages, msg)
-		s.MsgLock.Unlock()
+// setIdleDeadline sets the read deadline for client's next line. With an
+// idle timeout, the first deadline expires IdleWarning before the timeout so
+// the client can be warned; once warned, the second expires at the timeout.
+func (s *Server) setIdleDeadline(client *Client, warned bool) {
+	if s.IdleTimeout <= 0 {
+		return
+	}
+	wait := s.IdleTimeout - s.IdleWarning
+	if warned {
+		wait = s.IdleWarning
+	}
+	client.Conn.SetReadDeadline(time.Now().Add(wait))
+}
 
-		formattedMsg := fmt.Sprintf("[%s][%s]: %s\n", timestamp.Format("2006-01-02 15:04:05"), client.Username, message)
-		s.broadcast(formattedMsg, client.Username)
+// truncateUTF8 shortens s to at most max bytes without splitting a
+// multi-byte rune.
+func truncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	s = s[:max]
+	// Drop the bytes of a rune cut short by the slice.
+	for len(s) > 0 {
+		r, size := utf8.DecodeLastRuneInString(s)
+		if r != utf8.RuneError || size > 1 {
+			break
+		}
+		s = s[:len(s)-size]
 	}
+	return s
 }
 
-// broadcast sends a message to all clients except the sender.
-func (s *Server) broadcast(message, sender string) {
-	s.ClientsLock.Lock()
-	defer s.ClientsLock.Unlock()
+// readLine reads one line from r without its line ending. Lines longer than
+// the reader's buffer are returned in buffer-sized pieces.
+func readLine(r *bufio.Reader) (string, error) {
+	line, _, err := r.ReadLine()
+	return applyBackspaces(string(line)), err
+}
 
-	for _, client := range s.Clients {
-		if client.Username == sender {
-			continue
-		}
-		select {
-		case client.Out <- message:
-		default:
-			log.Printf("Client %s is slow. Dropping message.", client.Username)
+// applyBackspaces edits line as a terminal would have: each backspace or
+// DEL erases the character before it. Raw TCP clients without line
+// editing send these bytes as typed.
+func applyBackspaces(line string) string {
+	if !strings.ContainsAny(line, "\b\x7f") {
+		return line
+	}
+	kept := make([]rune, 0, len(line))
+	for _, r := range line {
+		switch {
+		case r != '\b' && r != 0x7f:
+			kept = append(kept, r)
+		case len(kept) > 0:
+			kept = kept[:len(kept)-1]
 		}
 	}
+	return string(kept)
 }
 
-// logActivity logs activities to the server's log file.
-func (s *Server) logActivity(activity string) {
-	log.Println(activity)
-	s.LogFile.WriteString(activity + "\n")
+// emptyReadGuard keeps a connection that returns (0, nil) from spinning the
+// read loop: empty reads are retried with a growing pause, and after
+// MaxEmptyReads of them in a row the connection is reported as broken.
+type emptyReadGuard struct {
+	r io.Reader
 }
 
-// Shutdown gracefully shuts down the server.
-func (s *Server) Shutdown() {
-	s.ClientsLock.Lock()
-	for _, client := range s.Clients {
-		client.Conn.Close()
+func (g emptyReadGuard) Read(p []byte) (int, error) {
+	pause := time.Millisecond
+	for i := 0; i < MaxEmptyReads; i++ {
+		n, err := g.r.Read(p)
+		if n > 0 || err != nil || len(p) == 0 {
+			return n, err
+		}
+		time.Sleep(pause)
+		pause *= 2
 	}
-	s.ClientsLock.Unlock()
-	s.LogFile.Close()
+	return 0, io.ErrNoProgress
 }
 
-func main() {
-	listen := flag.Bool("l", false, "Listen for incoming connections")
-	protocol := flag.String("u", string(TCP), "Choose between tcp or udp")
-	flag.Parse()
+// readBoundedLine reads one line from r like readLine, but gives up with
+// errNameTooLong once the line passes max bytes, so an unvalidated peer
+// can't make the server buffer an arbitrarily long line. The line is only
+// complete at a newline: however many reads it takes to arrive, a read
+// error (EOF, a deadline) before then discards it.
+func readBoundedLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(strings.TrimRight(string(line), "\r\n")) > max {
+			return "", errNameTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return applyBackspaces(strings.TrimRight(string(line), "\r\n")), nil
+	}
+}
+
+// receiveMessagesFromClient listens for incoming messages from a client, including slash commands.
+// It returns the reason the client stopped.
+func (s *Server) receiveMessagesFromClient(client *Client) string {
+	warned := false
+	for {
+		s.setIdleDeadline(client, warned)
+		line, err := readLine(client.reader)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if !warned && s.IdleWarning > 0 {
+				warned = true
+				client.Conn.Write([]byte(s.Format.Info(fmt.Sprintf("you will be disconnected for inactivity in %s", s.IdleWarning))))
+				continue
+			}
+			return "idle timeout"
+		}
+		if err == io.EOF && s.AllowHalfClose {
+			return reasonHalfClosed
+		}
+		if err != nil {
+			return "connection closed"
+		}
+		warned = false
+		s.ClientsLock.Lock()
+		client.LastActive = time.Now()
+		s.ClientsLock.Unlock()
 
-	port := DefaultPort
-	args := flag.Args()
+		if client.upload != nil {
+			s.receiveFileLine(client, strings.TrimSpace(line))
+			continue
+		}
 
-	if len(args) == 1 {
-		port = args[0]
-	}
+		message := strings.TrimSpace(line)
+		if s.MaxMsgLen > 0 && len(message) > s.MaxMsgLen {
+			message = truncateUTF8(message, s.MaxMsgLen)
+			s.reply(client.Conn, fmt.Sprintf("Message truncated to %d bytes.\n", s.MaxMsgLen))
+		}
 
-	if *listen || len(flag.Args()) == 0 || port != DefaultPort {
-		server := NewServer(Protocol(*protocol), port)
-		server.Start()
-	} else {
-		fmt.Println("[USAGE 1]: ./TCPChat -l -p <port> -u <tcp|udp>\n[USAGE 2]: ./TCPChat $port\n[USAGE 3]: ./TCPChat")
+		message = s.resolveAlias(message)
+		if message == "/exit" {
+			return "left the chat"
+		}
+
+		if s.handleCommand(client, message) {
+			continue
+		}
+		if strings.HasPrefix(message, "//") {
+			// A doubled slash escapes a message meant to start with one.
+			message = message[1:]
+		} else if strings.HasPrefix(message, "/") {
+			command, _, _ := strings.Cut(message, " ")
+			s.reply(client.Conn, fmt.Sprintf("Unknown command: %s. Type /help.\n", command))
+			continue
+		}
+
+		s.postChat(client, message, 0)
+	}
+}
+
+// postChat stores and broadcasts a chat message from client, replying to
+// message replyTo if it isn't 0. Plain messages and /reply both go through
+// it. It runs in client's own goroutine.
+func (s *Server) postChat(client *Client, content string, replyTo int) {
+	if !s.mayPost(client, content) {
+		return
+	}
+
+	msg := Message{Timestamp: client.LastPost, Client: client.Username, Content: content, ReplyTo: replyTo, Room: client.Room, Color: client.Color}
+	msg = s.storeMessage(msg)
+
+	s.broadcastMessage(msg, client.Username)
+	if s.Confirm {
+		client.Conn.Write([]byte(s.ack(msg)))
+	}
+}
+
+// mayPost reports whether client may post content now, telling it why not
+// otherwise: it must not be read-only or locked out, slow mode must allow
+// it and, with NoDupes, it must not repeat its last message. An allowed
+// post becomes client's last one. Chat, /reply and /edit all check it.
+func (s *Server) mayPost(client *Client, content string) bool {
+	if client.ReadOnly {
+		s.reply(client.Conn, "You are in read-only mode.\n")
+		return false
+	}
+	if s.lockedOut(client) {
+		return false
+	}
+	now := time.Now()
+	if wait := s.slowModeWait(client, now); wait > 0 {
+		s.reply(client.Conn, fmt.Sprintf("Slow mode: wait %ds.\n", int(math.Ceil(wait.Seconds()))))
+		return false
+	}
+	if s.NoDupes && content == client.LastMessage && now.Sub(client.LastPost) < DuplicateWindow {
+		s.reply(client.Conn, "Duplicate message suppressed.\n")
+		return false
+	}
+	client.LastPost = now
+	client.LastMessage = content
+	return true
+}
+
+// ack returns the receipt sent to a message's author when Confirm is set:
+// "[ack #seq]" if sequence numbers are shown, "✓" otherwise.
+func (s *Server) ack(msg Message) string {
+	switch f := s.Format.(type) {
+	case HumanFormatter:
+		if !f.ShowSeq {
+			return "✓\n"
+		}
+	case LineFormatter:
+		return f.Info(fmt.Sprintf("ack %d", msg.Seq))
+	}
+	return fmt.Sprintf("[ack #%d]\n", msg.Seq)
+}
+
+// storeMessage numbers msg, adds it to the history and the chat log and
+// counts it in the stats. It returns the numbered message.
+func (s *Server) storeMessage(msg Message) Message {
+	s.MsgLock.Lock()
+	s.LastSeq++
+	msg.Seq = s.LastSeq
+	s.Messages = append(s.Messages, msg)
+	s.historyBytes += len(msg.Content)
+	s.saveMessage(msg)
+	s.trimHistory()
+	s.MsgLock.Unlock()
+	s.logChat(msg)
+
+	s.StatsLock.Lock()
+	s.Stats.TotalMessages++
+	s.Stats.TotalBytes += len(msg.Content)
+	s.StatsLock.Unlock()
+	return msg
+}
+
+// trimHistory drops the oldest messages until the history fits both
+// HistoryMax and HistoryBytes. The history file keeps them. Callers hold
+// MsgLock.
+func (s *Server) trimHistory() {
+	drop := 0
+	for drop < len(s.Messages) &&
+		(s.HistoryMax > 0 && len(s.Messages)-drop > s.HistoryMax ||
+			s.HistoryBytes > 0 && s.historyBytes > s.HistoryBytes) {
+		s.historyBytes -= len(s.Messages[drop].Content)
+		drop++
+	}
+	if drop > 0 {
+		s.Messages = append([]Message(nil), s.Messages[drop:]...)
+	}
+}
+
+// findMessage returns the stored message numbered seq.
+func (s *Server) findMessage(seq int) (Message, bool) {
+	s.MsgLock.Lock()
+	defer s.MsgLock.Unlock()
+	for i := len(s.Messages) - 1; i >= 0; i-- {
+		if s.Messages[i].Seq == seq {
+			return s.Messages[i], true
+		}
+	}
+	return Message{}, false
+}
+
+// formatMessage renders msg as a chat line in the server's time zone.
+func (s *Server) formatMessage(msg Message) string {
+	return s.render(s.Format, msg)
+}
+
+// formatMessageFor renders msg for client, honoring its /timestamps
+// setting. Callers other than client's own goroutine hold ClientsLock.
+func (s *Server) formatMessageFor(client *Client, msg Message) string {
+	format := s.Format
+	if human, ok := format.(HumanFormatter); ok && client.HideTime {
+		human.HideTime = true
+		format = human
+	}
+	return s.render(format, msg)
+}
+
+// render formats msg with format in the server's time zone, as exactly one
+// line.
+func (s *Server) render(format Formatter, msg Message) string {
+	msg.Timestamp = msg.Timestamp.In(s.Location)
+	msg.Client, msg.Content = oneLine(msg.Client), oneLine(msg.Content)
+	if s.Colors && format.Interactive() {
+		msg.Client = colorize(msg.Client, msg.Color)
+	}
+	switch msg.Kind {
+	case KindAnnouncement:
+		return format.Announcement(msg)
+	case KindPrivate:
+		return format.Private(msg)
+	case KindShout:
+		return format.Shout(msg)
+	}
+	return format.Message(msg)
+}
+
+// handleCommand runs a slash command sent by client. It reports whether the
+// message was a command; the caller refuses other messages starting with a
+// slash and treats the rest as chat.
+func (s *Server) handleCommand(client *Client, message string) bool {
+	command, args, _ := strings.Cut(message, " ")
+	args = strings.TrimSpace(args)
+
+	if client.ReadOnly && sendCommands[command] {
+		s.reply(client.Conn, "You are in read-only mode.\n")
+		return true
+	}
+
+	user := client.Username
+	switch command {
+	case "/name":
+		s.changeName(client, args)
+	case "/admin":
+		s.claimAdmin(client, args)
+	case "/promote":
+		s.setAdmin(client, args, true)
+	case "/demote":
+		s.setAdmin(client, args, false)
+	case "/unname":
+		s.unname(client)
+	case "/stats":
+		s.sendStats(client, args)
+	case "/slowmode":
+		s.setSlowMode(client, args)
+	case "/shout":
+		s.shout(client, args)
+	case "/poll":
+		s.startPoll(client, args)
+	case "/vote":
+		s.vote(client, args)
+	case "/pollresult":
+		s.pollResult(client)
+	case "/pollend":
+		s.stopPoll(client)
+	case "/report":
+		s.report(client, args)
+	case "/lockdown":
+		s.setLockdown(client, args)
+	case "/ignore":
+		s.ignore(client, args, true)
+	case "/unignore":
+		s.ignore(client, args, false)
+	case "/seen":
+		s.seen(client, args)
+	case "/announce":
+		s.announce(client, args)
+	case "/msg":
+		s.privateMessage(client, args)
+	case "/reply":
+		s.replyToMessage(client, args)
+	case "/whoami":
+		s.whoami(client)
+	case "/status":
+		s.status(client)
+	case "/color":
+		s.setColor(client, args)
+	case "/features":
+		s.sendFeatures(client)
+	case "/version":
+		s.sendVersion(client)
+	case "/file":
+		s.startUpload(client, args)
+	case "/getfile":
+		s.sendFile(client, args)
+	case "/resume":
+		s.resume(client, args)
+	case "/roll":
+		s.roll(client, args)
+	case "/react":
+		s.react(client, args)
+	case "/reactions":
+		s.listReactions(client, args)
+	case "/edit":
+		s.editLastMessage(client, args, false)
+	case "/delete":
+		s.editLastMessage(client, "", true)
+	case "/sendfile":
+		s.broadcastFile(client, args)
+	case "/export":
+		s.export(client, args)
+	case "/whois":
+		s.whois(client, args)
+	case "/join":
+		s.joinRoom(client, args)
+	case "/rooms":
+		s.listRooms(client)
+	case "/kickall":
+		s.kickAll(client, args)
+	case "/eol":
+		s.setEOL(client, args)
+	case "/timestamps":
+		s.setTimestamps(client, args)
+	case "/audit":
+		s.sendAudit(client, args)
+	case "/cmdlog":
+		s.sendCmdLog(client, args)
+	case "/topic":
+		s.topic(client, args)
+	case "/topichistory":
+		s.topicHistory(client)
+	case "/get":
+		s.getMessage(client, args)
+	case "/help":
+		s.sendHelp(client)
+	case "/lurk":
+		s.setReadOnly(client, true)
+	case "/unlurk":
+		s.setReadOnly(client, false)
+	default:
+		return false
+	}
+	s.recordCommand(user, command, args)
+	return true
+}
+
+// changeName handles the /name command.
+func (s *Server) changeName(client *Client, newName string) {
+	if validateName(newName) != nil {
+		s.reply(client.Conn, "Invalid new name.\n")
+		return
+	}
+	if s.nameTooLong(newName) {
+		s.reply(client.Conn, errNameTooLong.Error()+"\n")
+		return
+	}
+
+	// Ensure the new name isn't already taken (a client may change the
+	// case of its own name)
+	s.ClientsLock.Lock()
+	if other := s.findClient(newName); other != nil && other != client {
+		s.reply(client.Conn, "This name is already taken.\n")
+		s.ClientsLock.Unlock()
+		return
+	}
+
+	// Broadcast the name change
+	oldName := client.Username
+	s.recordSeen(oldName, time.Now())
+	delete(s.Clients, client.Username) // Remove the old name
+	delete(s.folded, foldName(client.Username))
+	client.Username = newName   // Update the name
+	s.Clients[newName] = client // Add the new name
+	s.folded[foldName(newName)] = client
+
+	s.ClientsLock.Unlock()
+
+	// Notify others of the name change
+	s.broadcast(s.Format.Rename(oldName, newName), "INFO")
+	s.logActivity(fmt.Sprintf("Client %s changed their name to %s", oldName, newName))
+}
+
+// unname handles /unname, going back to the name the client joined with.
+func (s *Server) unname(client *Client) {
+	if client.Username == client.OriginalName {
+		s.reply(client.Conn, "You already use your original name.\n")
+		return
+	}
+	s.changeName(client, client.OriginalName)
+}
+
+// sendStats handles the /stats command. Admins may pass "reset" to zero the
+// message counters; the live client counts are left alone.
+func (s *Server) sendStats(client *Client, args string) {
+	if args == "reset" {
+		if !s.isAdmin(client) {
+			s.reply(client.Conn, "Only admins can reset stats.\n")
+			return
+		}
+		s.StatsLock.Lock()
+		s.Stats.TotalMessages = 0
+		s.Stats.TotalBytes = 0
+		s.StatsLock.Unlock()
+
+		s.reply(client.Conn, "Stats reset.\n")
+		s.logActivity(fmt.Sprintf("Client %s reset the stats.", client.Username))
+		return
+	}
+
+	s.ClientsLock.Lock()
+	clients := len(s.Clients)
+	s.ClientsLock.Unlock()
+
+	s.StatsLock.Lock()
+	stats := s.Stats
+	s.StatsLock.Unlock()
+
+	s.reply(client.Conn, fmt.Sprintf("[STATS]: clients=%d peak=%d messages=%d bytes=%d accepted=%d rejected=%d\n",
+		clients, stats.PeakClients, stats.TotalMessages, stats.TotalBytes, stats.Accepted, stats.Rejected))
+}
+
+// setSlowMode handles the admin /slowmode command.
+func (s *Server) setSlowMode(client *Client, args string) {
+	if !s.isAdmin(client) {
+		s.reply(client.Conn, "Only admins can set slow mode.\n")
+		return
+	}
+	seconds, err := strconv.Atoi(args)
+	if err != nil || seconds < 0 {
+		s.reply(client.Conn, "Usage: /slowmode <seconds>\n")
+		return
+	}
+
+	s.ModeLock.Lock()
+	s.SlowMode = time.Duration(seconds) * time.Second
+	s.ModeLock.Unlock()
+
+	if seconds == 0 {
+		s.broadcast(s.Format.Info("slow mode disabled"), "INFO")
+	} else {
+		s.broadcast(s.Format.Info(fmt.Sprintf("slow mode set to %ds", seconds)), "INFO")
+	}
+	s.logActivity(fmt.Sprintf("Client %s set slow mode to %ds.", client.Username, seconds))
+}
+
+// slowModeWait returns how long client must still wait before posting at
+// now, or zero if it may post.
+func (s *Server) slowModeWait(client *Client, now time.Time) time.Duration {
+	if s.isAdmin(client) || client.LastPost.IsZero() {
+		return 0
+	}
+	s.ModeLock.Lock()
+	interval := s.SlowMode
+	s.ModeLock.Unlock()
+
+	return client.LastPost.Add(interval).Sub(now)
+}
+
+// setLockdown handles the admin /lockdown on|off command.
+func (s *Server) setLockdown(client *Client, args string) {
+	if !s.isAdmin(client) {
+		s.reply(client.Conn, "Only admins can lock the chat.\n")
+		return
+	}
+	if args != "on" && args != "off" {
+		s.reply(client.Conn, "Usage: /lockdown on|off\n")
+		return
+	}
+
+	s.ModeLock.Lock()
+	s.Locked = args == "on"
+	s.ModeLock.Unlock()
+
+	state := "unlocked"
+	if args == "on" {
+		state = "locked"
+	}
+	s.broadcast(s.Format.Info("chat "+state), "INFO")
+	s.logActivity(fmt.Sprintf("Client %s %s the chat.", client.Username, state))
+}
+
+// lockedOut reports whether client can't post because the chat is locked,
+// telling it so.
+func (s *Server) lockedOut(client *Client) bool {
+	if s.isAdmin(client) {
+		return false
+	}
+	s.ModeLock.Lock()
+	locked := s.Locked
+	s.ModeLock.Unlock()
+	if locked {
+		s.reply(client.Conn, "Chat is locked.\n")
+	}
+	return locked
+}
+
+// setReadOnly handles /lurk and /unlurk.
+func (s *Server) setReadOnly(client *Client, on bool) {
+	s.ClientsLock.Lock()
+	client.ReadOnly = on
+	s.ClientsLock.Unlock()
+	if on {
+		s.reply(client.Conn, "Read-only mode on. Use /unlurk to send messages again.\n")
+	} else {
+		s.reply(client.Conn, "Read-only mode off.\n")
+	}
+}
+
+// setTimestamps handles /timestamps on|off.
+func (s *Server) setTimestamps(client *Client, args string) {
+	var hide bool
+	switch strings.ToLower(args) {
+	case "on":
+	case "off":
+		hide = true
+	default:
+		s.reply(client.Conn, "Usage: /timestamps on|off\n")
+		return
+	}
+	s.ClientsLock.Lock()
+	client.HideTime = hide
+	s.ClientsLock.Unlock()
+	s.reply(client.Conn, fmt.Sprintf("Timestamps %s.\n", strings.ToLower(args)))
+}
+
+// setEOL handles /eol crlf|lf, choosing how the lines delivered to client
+// end.
+func (s *Server) setEOL(client *Client, args string) {
+	mode := strings.ToLower(args)
+	if mode != "crlf" && mode != "lf" {
+		s.reply(client.Conn, "Usage: /eol crlf|lf\n")
+		return
+	}
+	client.eol.crlf.Store(mode == "crlf")
+	s.reply(client.Conn, fmt.Sprintf("Line endings set to %s.\n", mode))
+}
+
+// eolConn is a client's connection. With crlf set (by /eol crlf), every
+// line written to it, queued or sent directly, ends in "\r\n".
+type eolConn struct {
+	net.Conn
+	crlf atomic.Bool
+}
+
+func (c *eolConn) Write(p []byte) (int, error) {
+	if !c.crlf.Load() {
+		return c.Conn.Write(p)
+	}
+	if _, err := c.Conn.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// whoami handles the /whoami command.
+func (s *Server) whoami(client *Client) {
+	admin := "no"
+	if s.isAdmin(client) {
+		admin = "yes"
+	}
+	s.reply(client.Conn, fmt.Sprintf("You are %s, joined %s, admin: %s, room: #%s.\n",
+		client.Username, client.JoinedAt.In(s.Location).Format(TimeFormat), admin, client.Room))
+}
+
+// status handles /status: the client's room and everything that may keep
+// its messages from going out.
+func (s *Server) status(client *Client) {
+	s.ClientsLock.Lock()
+	room, lurking, ignoring, admin := client.Room, client.ReadOnly, len(client.Ignored), client.Admin
+	s.ClientsLock.Unlock()
+
+	s.ModeLock.Lock()
+	locked := s.Locked && !admin
+	s.ModeLock.Unlock()
+
+	wait := max(s.slowModeWait(client, time.Now()), 0)
+	s.reply(client.Conn, fmt.Sprintf("Room: #%s, lurking: %s, chat locked: %s, slow mode wait: %ds, ignoring: %d.\n",
+		room, yesNo(lurking), yesNo(locked), int(math.Ceil(wait.Seconds())), ignoring))
+}
+
+// replyToMessage handles /reply <seq> <text>, a chat message that refers to an
+// earlier one.
+func (s *Server) replyToMessage(client *Client, args string) {
+	seqArg, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	seq, err := strconv.Atoi(strings.TrimPrefix(seqArg, "#"))
+	if err != nil || text == "" {
+		s.reply(client.Conn, "Usage: /reply <seq> <text>\n")
+		return
+	}
+	if _, ok := s.findMessage(seq); !ok {
+		s.reply(client.Conn, fmt.Sprintf("No message #%d in history.\n", seq))
+		return
+	}
+	s.postChat(client, text, seq)
+}
+
+// editLastMessage handles /edit <text> and /delete, which change or remove
+// the client's most recent chat message. Lines already shown can't be
+// changed, so the room gets a notice; the edit shows in later history
+// replays.
+func (s *Server) editLastMessage(client *Client, text string, remove bool) {
+	verb := "edit"
+	if remove {
+		verb = "delete"
+	} else if text == "" {
+		s.reply(client.Conn, "Usage: /edit <new text>\n")
+		return
+	} else if !s.mayPost(client, text) {
+		return
+	}
+
+	s.MsgLock.Lock()
+	i := len(s.Messages) - 1
+	for ; i >= 0; i-- {
+		if s.Messages[i].Client == client.Username && s.Messages[i].Kind == "" {
+			break
+		}
+	}
+	if i < 0 {
+		s.MsgLock.Unlock()
+		s.reply(client.Conn, fmt.Sprintf("You have no messages to %s.\n", verb))
+		return
+	}
+	room := s.Messages[i].Room
+	s.historyBytes -= len(s.Messages[i].Content)
+	if remove {
+		s.saveMessage(Message{Seq: s.Messages[i].Seq, Deleted: true})
+		s.saveLastSeq()
+		s.Messages = append(s.Messages[:i], s.Messages[i+1:]...)
+	} else {
+		s.Messages[i].Content = text
+		s.historyBytes += len(text)
+		s.saveMessage(s.Messages[i])
+		s.trimHistory()
+	}
+	s.MsgLock.Unlock()
+
+	if room == "" {
+		room = DefaultRoom
+	}
+	if remove {
+		s.roomNotice(room, fmt.Sprintf("%s deleted their last message", client.Username), "", client.Username)
+	} else {
+		s.roomNotice(room, fmt.Sprintf("%s edited their last message: %s", client.Username, text), "", client.Username)
+	}
+}
+
+// privateMessage handles /msg <user> <text>. Private messages are not kept
+// in the history.
+func (s *Server) privateMessage(client *Client, args string) {
+	target, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	if target == "" || text == "" {
+		s.reply(client.Conn, "Usage: /msg <user> <text>\n")
+		return
+	}
+
+	msg := Message{Timestamp: time.Now(), Client: client.Username, Content: text, Kind: KindPrivate, Color: client.Color}
+	s.ClientsLock.Lock()
+	recipient := s.findClient(target)
+	if recipient != nil {
+		target = recipient.Username
+		if recipient != client && !recipient.Ignored[foldName(client.Username)] {
+			s.enqueue(recipient, s.formatMessageFor(recipient, msg))
+		}
+	}
+	s.ClientsLock.Unlock()
+
+	switch {
+	case recipient == nil:
+		s.reply(client.Conn, fmt.Sprintf("%s is not online.\n", target))
+	case recipient == client:
+		s.reply(client.Conn, "You can't message yourself.\n")
+	default:
+		s.reply(client.Conn, fmt.Sprintf("Message sent to %s.\n", target))
+	}
+}
+
+// ignore handles /ignore and /unignore, which only affect what client sees.
+func (s *Server) ignore(client *Client, target string, on bool) {
+	if target == "" {
+		if on {
+			s.reply(client.Conn, "Usage: /ignore <user>\n")
+		} else {
+			s.reply(client.Conn, "Usage: /unignore <user>\n")
+		}
+		return
+	}
+
+	s.ClientsLock.Lock()
+	if other := s.findClient(target); other != nil {
+		target = other.Username
+	}
+	key := foldName(target)
+	var reply string
+	saved := false
+	switch {
+	case key == foldName(client.Username):
+		reply = "You can't ignore yourself.\n"
+	case on && !client.Ignored[key] && len(client.Ignored) >= MaxIgnores:
+		reply = fmt.Sprintf("You can ignore at most %d users.\n", MaxIgnores)
+	case on:
+		client.Ignored[key] = true
+		s.saveIgnores(client)
+		saved = true
+		reply = fmt.Sprintf("You are now ignoring %s.\n", target)
+	case client.Ignored[key]:
+		delete(client.Ignored, key)
+		s.saveIgnores(client)
+		saved = true
+		reply = fmt.Sprintf("You are no longer ignoring %s.\n", target)
+	default:
+		reply = fmt.Sprintf("You are not ignoring %s.\n", target)
+	}
+	s.ClientsLock.Unlock()
+
+	if saved {
+		s.writeIgnores()
+	}
+	s.reply(client.Conn, reply)
+}
+
+// seen handles the /seen command.
+func (s *Server) seen(client *Client, target string) {
+	if target == "" {
+		s.reply(client.Conn, "Usage: /seen <user>\n")
+		return
+	}
+
+	s.ClientsLock.Lock()
+	other := s.findClient(target)
+	online := other != nil
+	if online {
+		target = other.Username
+	}
+	last, known := s.LastSeen[foldName(target)]
+	s.ClientsLock.Unlock()
+
+	switch {
+	case online:
+		s.reply(client.Conn, fmt.Sprintf("%s is currently online.\n", target))
+	case known:
+		s.reply(client.Conn, fmt.Sprintf("%s was last seen %s (%s ago).\n",
+			target, last.In(s.Location).Format(TimeFormat), time.Since(last).Round(time.Second)))
+	default:
+		s.reply(client.Conn, fmt.Sprintf("%s has never been seen.\n", target))
+	}
+}
+
+// announce handles the admin /announce command. Unlike chat messages,
+// announcements also reach the sender.
+func (s *Server) announce(client *Client, text string) {
+	if !s.isAdmin(client) {
+		s.reply(client.Conn, "Only admins can make announcements.\n")
+		return
+	}
+	if text == "" {
+		s.reply(client.Conn, "Usage: /announce <text>\n")
+		return
+	}
+
+	msg := Message{Timestamp: time.Now(), Client: client.Username, Content: text, Kind: KindAnnouncement}
+	msg = s.storeMessage(msg)
+	s.broadcastMessage(msg, "INFO")
+	s.logActivity(fmt.Sprintf("Client %s announced: %s", client.Username, text))
+}
+
+// shout handles /shout <text>, an uppercased message to the room. Shouts
+// are limited to one per ShoutInterval.
+func (s *Server) shout(client *Client, text string) {
+	if text == "" {
+		s.reply(client.Conn, "Usage: /shout <text>\n")
+		return
+	}
+	if s.lockedOut(client) {
+		return
+	}
+	now := time.Now()
+	if wait := client.LastShout.Add(ShoutInterval).Sub(now); wait > 0 {
+		s.reply(client.Conn, fmt.Sprintf("You can shout again in %ds.\n", int(math.Ceil(wait.Seconds()))))
+		return
+	}
+	client.LastShout = now
+
+	msg := Message{Timestamp: now, Client: client.Username, Content: strings.ToUpper(text), Kind: KindShout, Room: client.Room, Color: client.Color}
+	msg = s.storeMessage(msg)
+	s.broadcastMessage(msg, client.Username)
+}
+
+// resume handles /resume <seq>, telling the client how many messages were
+// posted after the last one it saw.
+func (s *Server) resume(client *Client, args string) {
+	seq, err := strconv.Atoi(args)
+	if err != nil || seq < 0 {
+		s.reply(client.Conn, "Usage: /resume <seq>\n")
+		return
+	}
+	s.sendMissed(client, seq)
+}
+
+// sendMissed tells client how many messages were stored after seq.
+func (s *Server) sendMissed(client *Client, seq int) {
+	s.MsgLock.Lock()
+	missed := s.LastSeq - seq
+	s.MsgLock.Unlock()
+	if missed < 0 {
+		missed = 0
+	}
+	client.Conn.Write([]byte(s.Format.Info(fmt.Sprintf("you missed %d messages", missed))))
+}
+
+// kickAll handles /kickall [reason], disconnecting everyone but the admin
+// who ran it, e.g. before maintenance.
+func (s *Server) kickAll(client *Client, reason string) {
+	if !s.isAdmin(client) {
+		s.reply(client.Conn, "Only admins can kick everyone.\n")
+		return
+	}
+	if reason == "" {
+		reason = "kicked by admin"
+	}
+
+	s.ClientsLock.Lock()
+	targets := make([]*Client, 0, len(s.Clients))
+	for _, other := range s.Clients {
+		if other != client {
+			targets = append(targets, other)
+		}
+	}
+	s.ClientsLock.Unlock()
+
+	s.broadcast(s.Format.Info("everyone is being disconnected: "+reason), client.Username)
+	for _, target := range targets {
+		s.disconnect(target, reason)
+	}
+	s.reply(client.Conn, fmt.Sprintf("Kicked %d clients.\n", len(targets)))
+	s.logActivity(fmt.Sprintf("Client %s kicked %d clients (%s).", client.Username, len(targets), reason))
+}
+
+// recordSeen remembers when username was last active, matching it without
+// regard to case. Once MaxLastSeen names are stored the oldest one is
+// forgotten. Callers hold ClientsLock.
+func (s *Server) recordSeen(username string, at time.Time) {
+	key := foldName(username)
+	s.LastSeen[key] = at
+	if len(s.LastSeen) <= MaxLastSeen {
+		return
+	}
+	oldest := key
+	for name, t := range s.LastSeen {
+		if t.Before(s.LastSeen[oldest]) {
+			oldest = name
+		}
+	}
+	delete(s.LastSeen, oldest)
+	delete(s.leftAtSeq, oldest)
+}
+
+// broadcast sends a message to all clients except the sender and those
+// ignoring them.
+func (s *Server) broadcast(message, sender string) {
+	s.ClientsLock.Lock()
+	defer s.ClientsLock.Unlock()
+
+	for _, client := range s.Clients {
+		if client.Username == sender || client.Ignored[foldName(sender)] {
+			continue
+		}
+		s.enqueue(client, message)
+	}
+}
+
+// Announce sends a system message to every client and returns once it has
+// been written to all of them, or after ShutdownTimeout. Clients that
+// disconnect meanwhile aren't waited for. It is meant for maintenance
+// notices such as "server restarting, reconnect in 30s".
+func (s *Server) Announce(text string) {
+	message := s.Format.Info(text)
+
+	// Each client's copy is its latest queued line; once that many lines
+	// are delivered, so is the announcement.
+	type pending struct {
+		client *Client
+		upTo   int64
+	}
+	s.ClientsLock.Lock()
+	waiting := make([]pending, 0, len(s.Clients))
+	for _, client := range s.Clients {
+		queued := client.queued
+		s.enqueue(client, message)
+		if client.queued > queued {
+			waiting = append(waiting, pending{client, int64(client.queued)})
+		}
+	}
+	s.ClientsLock.Unlock()
+	s.logActivity("Announced: " + text)
+
+	deadline := time.Now().Add(ShutdownTimeout)
+	for _, p := range waiting {
+		for p.client.delivered.Load() < p.upTo && time.Now().Before(deadline) {
+			s.ClientsLock.Lock()
+			gone := p.client.disconnected
+			s.ClientsLock.Unlock()
+			if gone {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+// broadcastMessage sends a chat message to the same clients as broadcast
+// that are in the message's room, rendering it for each recipient.
+func (s *Server) broadcastMessage(msg Message, sender string) {
+	if s.Fanout > 1 {
+		s.fanOut(msg, sender)
+		return
+	}
+	s.ClientsLock.Lock()
+	defer s.ClientsLock.Unlock()
+
+	for _, client := range s.Clients {
+		if client.Username == sender || client.Ignored[foldName(sender)] || !visibleIn(msg, client.Room) {
+			continue
+		}
+		s.enqueue(client, s.formatMessageFor(client, msg))
+	}
+}
+
+// fanOut is broadcastMessage for servers with many clients. ClientsLock is
+// only held to pick the recipients and to queue their lines; rendering the
+// lines, the costly part (especially with signed output), is spread over
+// Fanout workers in between.
+func (s *Server) fanOut(msg Message, sender string) {
+	type delivery struct {
+		client *Client
+		format Formatter
+		line   string
+	}
+
+	s.ClientsLock.Lock()
+	deliveries := make([]delivery, 0, len(s.Clients))
+	for _, client := range s.Clients {
+		if client.Username == sender || client.Ignored[foldName(sender)] || !visibleIn(msg, client.Room) {
+			continue
+		}
+		format := s.Format
+		if human, ok := format.(HumanFormatter); ok && client.HideTime {
+			human.HideTime = true
+			format = human
+		}
+		deliveries = append(deliveries, delivery{client: client, format: format})
+	}
+	s.ClientsLock.Unlock()
+
+	var wg sync.WaitGroup
+	workers := min(s.Fanout, len(deliveries))
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(deliveries); i += workers {
+				deliveries[i].line = s.render(deliveries[i].format, msg)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	s.ClientsLock.Lock()
+	defer s.ClientsLock.Unlock()
+	for _, d := range deliveries {
+		// Clients that left while the lines were rendered are skipped
+		// by enqueue.
+		s.enqueue(d.client, d.line)
+	}
+}
+
+// reply writes text, a direct answer or prompt, to conn through
+// s.Format.Reply, so that in the line protocol it is tagged and signed like
+// every other line.
+func (s *Server) reply(conn net.Conn, text string) error {
+	_, err := conn.Write([]byte(s.Format.Reply(text)))
+	return err
+}
+
+// enqueue queues message for delivery to client, dropping it if the client
+// is too far behind. A client that has MaxDrops messages dropped in a row
+// is evicted. Clients already disconnected are skipped: their Out channel
+// is closed. Callers hold ClientsLock.
+func (s *Server) enqueue(client *Client, message string) {
+	if client.disconnected {
+		return
+	}
+	select {
+	case client.Out <- message:
+		client.dropped = 0
+		client.queued++
+	default:
+		if summary, ok := s.coalesce("slow client"); ok {
+			if summary != "" {
+				log.Print(summary)
+			}
+			log.Printf("Client %s is slow. Dropping message.", client.Username)
+		}
+		client.dropped++
+		if client.dropped == s.MaxDrops {
+			go s.evict(client)
+		}
+	}
+}
+
+// evict disconnects a client that stopped reading. Its pending writes are
+// given ProbeTimeout to complete so a full socket can't block the
+// disconnect.
+func (s *Server) evict(client *Client) {
+	client.Conn.SetWriteDeadline(time.Now().Add(ProbeTimeout))
+	s.disconnect(client, "too far behind")
+}
+
+// findClient returns the connected client whose name matches name ignoring
+// case, or nil. Callers hold ClientsLock.
+func (s *Server) findClient(name string) *Client {
+	return s.folded[foldName(name)]
+}
+
+// foldName normalizes a username for case-insensitive comparison.
+func foldName(name string) string {
+	return strings.ToLower(name)
+}
+
+// logActivity logs activities to the server's log file and keeps the
+// most recent for /audit.
+func (s *Server) logActivity(activity string) {
+	activity = oneLine(activity)
+	log.Println(activity)
+	if _, err := s.LogFile.WriteString(activity + "\n"); err != nil {
+		log.Printf("Could not write to the log file: %v", err)
+	}
+	s.recordAudit(activity)
+}
+
+// logChat writes a stored message (chat, reply, shout or announcement) to
+// ChatLog, or to LogFile with LogChat, in the server's output format
+// without colors.
+func (s *Server) logChat(msg Message) {
+	target := s.ChatLog
+	if target == nil {
+		if !s.LogChat {
+			return
+		}
+		target = s.LogFile
+	}
+	msg.Color = ""
+	if _, err := target.WriteString(s.formatMessage(msg)); err != nil {
+		log.Printf("Could not write to the chat log: %v", err)
+	}
+}
+
+// Shutdown gracefully shuts down the server. Teardown happens in a fixed
+// order so nothing sends on a closed Out channel: it stops accepting and
+// stops the periodic broadcasters (presence, tips) by closing done, then
+// disconnects every client, which under ClientsLock marks it disconnected
+// and removes it from Clients before closing its Out channel and then its
+// connection. Every send happens in enqueue, under ClientsLock, and skips
+// disconnected clients. Finally it waits up to ShutdownTimeout for the
+// client goroutines to finish before closing the log files.
+func (s *Server) Shutdown() {
+	s.ClientsLock.Lock()
+	if s.closed {
+		s.ClientsLock.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.wsListener != nil {
+		s.wsListener.Close()
+	}
+	clients := make([]*Client, 0, len(s.Clients))
+	for _, client := range s.Clients {
+		clients = append(clients, client)
+	}
+	s.ClientsLock.Unlock()
+
+	for _, client := range clients {
+		s.disconnect(client, "server shutting down")
+	}
+
+	// Close connections still at the name prompt.
+	s.ClientsLock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.ClientsLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(ShutdownTimeout):
+		log.Println("Timed out waiting for clients to disconnect.")
+	}
+	s.flushCoalesced()
+	s.LogFile.Close()
+	if s.ChatLog != nil {
+		s.ChatLog.Close()
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run starts the chat as configured by args and returns the exit code.
+func run(args []string) int {
+	config, err := ParseConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return ExitOK
+	}
+	if err != nil {
+		log.Printf("Invalid arguments (exit %d): %v", ExitUsage, err)
+		return ExitUsage
+	}
+
+	if !config.Listen && len(config.Args) > 0 && config.Port == DefaultPort {
+		fmt.Println("[USAGE 1]: ./TCPChat -l -p <port> -u <tcp|udp>\n[USAGE 2]: ./TCPChat $port\n[USAGE 3]: ./TCPChat")
+		return ExitUsage
+	}
+
+	server, err := config.NewServer()
+	var usage *usageError
+	if errors.As(err, &usage) {
+		log.Printf("Invalid configuration (exit %d): %v", ExitUsage, err)
+		return ExitUsage
+	}
+	if err != nil {
+		log.Printf("Could not load configuration (exit %d): %v", ExitError, err)
+		return ExitError
+	}
+	if config.Check {
+		server.Shutdown()
+		fmt.Println("configuration OK")
+		return ExitOK
+	}
+
+	// Over TCP, SIGINT and SIGTERM warn the clients, then shut down; Start
+	// returns once the listener is closed. UDP keeps the default handling.
+	stopped := make(chan struct{})
+	if server.Protocol == TCP {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(stop)
+		go func() {
+			<-stop
+			server.Announce("server shutting down")
+			server.Shutdown()
+			close(stopped)
+		}()
+	}
+
+	// SIGHUP reloads the MOTD, logo, banlist and allowlist.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			server.Reload()
+		}
+	}()
+
+	if err := server.Start(); err != nil {
+		server.Shutdown()
+		log.Printf("Could not listen on port %s (exit %d): %v", server.Port, ExitBind, err)
+		return ExitBind
 	}
+	<-stopped
+	return ExitOK
 }
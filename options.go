@@ -0,0 +1,57 @@
+package main
+
+import "time"
+
+// Option changes one setting of a server built by NewServerWithOptions.
+type Option func(*Server)
+
+// WithProtocol sets the transport.
+func WithProtocol(protocol Protocol) Option {
+	return func(s *Server) { s.Protocol = protocol }
+}
+
+// WithPort sets the port to listen on.
+func WithPort(port string) Option {
+	return func(s *Server) { s.Port = port }
+}
+
+// WithMaxClients sets how many clients may be connected at once.
+func WithMaxClients(n int) Option {
+	return func(s *Server) { s.MaxClients = n }
+}
+
+// WithLogFile sets the activity log path, with rotation once it would pass
+// maxSize bytes (0 disables it), keeping keep rotated files.
+func WithLogFile(path string, maxSize int64, keep int) Option {
+	return func(s *Server) { s.LogFile = &LogFile{Path: path, MaxSize: maxSize, Keep: keep} }
+}
+
+// WithFormat sets the output format.
+func WithFormat(format Formatter) Option {
+	return func(s *Server) { s.Format = format }
+}
+
+// WithHistory persists the chat history to path. Call LoadHistory to
+// replay what the file already holds.
+func WithHistory(path string) Option {
+	return func(s *Server) { s.HistoryFile = path }
+}
+
+// WithFiles sets the MOTD, logo, banlist and allowlist files. Call
+// LoadFiles to read them.
+func WithFiles(motd, logo, banlist, allowlist string) Option {
+	return func(s *Server) {
+		s.MOTDFile, s.LogoFile, s.BanFile, s.AllowFile = motd, logo, banlist, allowlist
+	}
+}
+
+// WithIdleTimeout disconnects clients inactive for timeout, warning them
+// warning beforehand.
+func WithIdleTimeout(timeout, warning time.Duration) Option {
+	return func(s *Server) { s.IdleTimeout, s.IdleWarning = timeout, warning }
+}
+
+// WithAuth sets how clients are authenticated after giving their name.
+func WithAuth(auth Authenticator) Option {
+	return func(s *Server) { s.Auth = auth }
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestNewServerWithOptions tests that options change only the settings
+// they name.
+func TestNewServerWithOptions(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "chat.log")
+	server := NewServerWithOptions(
+		WithProtocol(UDP),
+		WithPort("9200"),
+		WithMaxClients(3),
+		WithLogFile(logPath, 1024, 2),
+		WithIdleTimeout(time.Minute, 10*time.Second),
+		WithAuth(StaticPasswordAuth{Password: "secret"}),
+	)
+	defer server.Shutdown()
+
+	if server.Protocol != UDP || server.Port != "9200" || server.MaxClients != 3 {
+		t.Errorf("Got %s port %s maxclients %d", server.Protocol, server.Port, server.MaxClients)
+	}
+	if server.LogFile.Path != logPath || server.LogFile.MaxSize != 1024 || server.LogFile.Keep != 2 {
+		t.Errorf("Log file options not applied: %+v", server.LogFile)
+	}
+	if server.IdleTimeout != time.Minute || server.IdleWarning != 10*time.Second {
+		t.Errorf("Got idle %s warning %s", server.IdleTimeout, server.IdleWarning)
+	}
+	if _, ok := server.Auth.(StaticPasswordAuth); !ok {
+		t.Errorf("Got authenticator %T", server.Auth)
+	}
+	if server.BufSize != DefaultBufSize || server.FullMessage != DefaultFullMessage {
+		t.Error("Settings without an option should keep their defaults")
+	}
+
+	if plain := NewServerWithOptions(); plain.Protocol != TCP || plain.Port != DefaultPort {
+		t.Errorf("Default server is %s on port %s", plain.Protocol, plain.Port)
+	}
+}
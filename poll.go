@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPollDuration is how long a poll stays open unless ended early.
+const DefaultPollDuration = 5 * time.Minute
+
+// Poll is a question clients vote on with /vote.
+type Poll struct {
+	Question string
+	Options  []string
+	Owner    string          // who started it
+	Votes    map[*Client]int // option index by voter, kept across renames
+	timer    *time.Timer
+}
+
+// tally returns the number of votes for each option.
+func (p *Poll) tally() []int {
+	counts := make([]int, len(p.Options))
+	for _, choice := range p.Votes {
+		counts[choice]++
+	}
+	return counts
+}
+
+// results formats the tally on one line.
+func (p *Poll) results() string {
+	counts := p.tally()
+	parts := make([]string, len(p.Options))
+	for i, option := range p.Options {
+		parts[i] = fmt.Sprintf("%s: %d", option, counts[i])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parsePoll splits /poll arguments into a question, quoted if it has
+// spaces, and the options after it.
+func parsePoll(args string) (question string, options []string, ok bool) {
+	if rest, found := strings.CutPrefix(args, `"`); found {
+		question, args, found = strings.Cut(rest, `"`)
+		if !found {
+			return "", nil, false
+		}
+	} else {
+		question, args, _ = strings.Cut(args, " ")
+	}
+	question = strings.TrimSpace(question)
+	options = strings.Fields(args)
+	return question, options, question != "" && len(options) >= 2
+}
+
+// startPoll handles /poll "question" <option> <option>...
+func (s *Server) startPoll(client *Client, args string) {
+	if s.PollAdminOnly && !s.isAdmin(client) {
+		s.reply(client.Conn, "Only admins can start polls.\n")
+		return
+	}
+	question, options, ok := parsePoll(args)
+	if !ok {
+		s.reply(client.Conn, "Usage: /poll \"question\" <option> <option>...\n")
+		return
+	}
+	if s.lockedOut(client) {
+		return
+	}
+
+	s.PollLock.Lock()
+	if s.poll != nil {
+		s.PollLock.Unlock()
+		s.reply(client.Conn, "A poll is already running; it must end first.\n")
+		return
+	}
+	poll := &Poll{Question: question, Options: options, Owner: client.Username, Votes: make(map[*Client]int)}
+	poll.timer = time.AfterFunc(s.PollDuration, func() { s.endPoll(poll) })
+	s.poll = poll
+	s.PollLock.Unlock()
+
+	s.broadcast(s.Format.Info(fmt.Sprintf("%s started a poll: %s", client.Username, question)), "INFO")
+	for i, option := range options {
+		s.broadcast(s.Format.Info(fmt.Sprintf("%d) %s", i+1, option)), "INFO")
+	}
+	s.broadcast(s.Format.Info(fmt.Sprintf("vote with /vote <n>; the poll closes in %s", s.PollDuration)), "INFO")
+	s.logActivity(fmt.Sprintf("Client %s started a poll: %s", client.Username, question))
+}
+
+// vote handles /vote <n>. Each client gets one vote per poll.
+func (s *Server) vote(client *Client, args string) {
+	s.PollLock.Lock()
+	defer s.PollLock.Unlock()
+	if s.poll == nil {
+		s.reply(client.Conn, "There is no poll running.\n")
+		return
+	}
+	n, err := strconv.Atoi(args)
+	if err != nil || n < 1 || n > len(s.poll.Options) {
+		s.reply(client.Conn, fmt.Sprintf("Usage: /vote <1-%d>\n", len(s.poll.Options)))
+		return
+	}
+	if _, voted := s.poll.Votes[client]; voted {
+		s.reply(client.Conn, "You already voted.\n")
+		return
+	}
+	s.poll.Votes[client] = n - 1
+	s.reply(client.Conn, fmt.Sprintf("Vote for %s recorded.\n", s.poll.Options[n-1]))
+}
+
+// pollResult handles /pollresult.
+func (s *Server) pollResult(client *Client) {
+	s.PollLock.Lock()
+	defer s.PollLock.Unlock()
+	if s.poll == nil {
+		s.reply(client.Conn, "There is no poll running.\n")
+		return
+	}
+	s.reply(client.Conn, fmt.Sprintf("[POLL]: %s — %s\n", s.poll.Question, s.poll.results()))
+}
+
+// stopPoll handles /pollend, which the poll's owner or an admin may use.
+func (s *Server) stopPoll(client *Client) {
+	s.PollLock.Lock()
+	poll := s.poll
+	s.PollLock.Unlock()
+	if poll == nil {
+		s.reply(client.Conn, "There is no poll running.\n")
+		return
+	}
+	if !s.isAdmin(client) && poll.Owner != client.Username {
+		s.reply(client.Conn, "Only the poll's owner or an admin can end it.\n")
+		return
+	}
+	s.endPoll(poll)
+}
+
+// endPoll closes poll, if it is still the running one, and announces the
+// results.
+func (s *Server) endPoll(poll *Poll) {
+	s.PollLock.Lock()
+	if s.poll != poll {
+		s.PollLock.Unlock()
+		return
+	}
+	s.poll = nil
+	poll.timer.Stop()
+	results := poll.results()
+	s.PollLock.Unlock()
+
+	s.broadcast(s.Format.Info(fmt.Sprintf("poll closed: %s — %s", poll.Question, results)), "INFO")
+	s.logActivity(fmt.Sprintf("Poll closed: %s — %s", poll.Question, results))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPoll tests creating a poll, voting, rejecting a second vote even
+// after a rename, the running tally and closing the poll with /pollend.
+func TestPoll(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+
+	bob.send("/vote 1")
+	bob.expect("There is no poll running.")
+	bob.send("/poll lunch?")
+	bob.expect(`Usage: /poll "question" <option> <option>...`)
+
+	bob.send(`/poll "Where to eat?" pizza sushi`)
+	admin.expect("[INFO]: Bob started a poll: Where to eat?")
+	admin.expect("[INFO]: 1) pizza")
+	admin.expect("[INFO]: 2) sushi")
+	bob.send("/poll again? yes no")
+	bob.expect("A poll is already running; it must end first.")
+
+	admin.send("/vote 3")
+	admin.expect("Usage: /vote <1-2>")
+	admin.send("/vote 2")
+	admin.expect("Vote for sushi recorded.")
+	admin.send("/vote 1")
+	admin.expect("You already voted.")
+	admin.send("/name Other")
+	bob.expect("Admin changed their name to Other")
+	admin.send("/vote 1")
+	admin.expect("You already voted.")
+	bob.send("/vote 2")
+	bob.expect("Vote for sushi recorded.")
+
+	bob.send("/pollresult")
+	bob.expect("[POLL]: Where to eat? — pizza: 0, sushi: 2")
+
+	bob.send("/pollend")
+	admin.expect("[INFO]: poll closed: Where to eat? — pizza: 0, sushi: 2")
+	bob.send("/pollresult")
+	bob.expect("There is no poll running.")
+}
+
+// TestPollTimeout tests that a poll closes by itself, and that -polladmin
+// keeps other clients from starting one.
+func TestPollTimeout(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.PollDuration = 200 * time.Millisecond
+		s.PollAdminOnly = true
+	})
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+
+	bob.send("/poll tea? yes no")
+	bob.expect("Only admins can start polls.")
+	bob.send("/pollend")
+	bob.expect("There is no poll running.")
+
+	admin.send("/poll tea? yes no")
+	bob.expect("[INFO]: Admin started a poll: tea?")
+	bob.send("/pollend")
+	bob.expect("Only the poll's owner or an admin can end it.")
+	bob.send("/vote 1")
+	bob.expect("Vote for yes recorded.")
+	bob.expect("[INFO]: poll closed: tea? — yes: 1, no: 0")
+}
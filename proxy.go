@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyHeaderTimeout bounds how long a connection may take to send its
+// PROXY header.
+const ProxyHeaderTimeout = 5 * time.Second
+
+// maxProxyHeader is the longest PROXY protocol v1 line, CRLF included.
+const maxProxyHeader = 107
+
+// readProxyHeader reads a PROXY protocol v1 line from conn, such as
+//
+//	PROXY TCP4 192.168.0.1 192.168.0.11 56324 8989
+//
+// and returns the client address it gives. For "PROXY UNKNOWN" it returns
+// nil, and the connection's own address should be used.
+func readProxyHeader(conn net.Conn) (net.Addr, error) {
+	conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+		if len(line) >= maxProxyHeader {
+			return nil, errors.New("header too long")
+		}
+	}
+	if len(line) == 0 || line[len(line)-1] != '\r' {
+		return nil, errors.New("header not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-1]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errors.New("not a PROXY header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || net.ParseIP(fields[3]) == nil {
+		return nil, fmt.Errorf("bad addresses in %q", line)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad source port in %q", line)
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, fmt.Errorf("bad destination port in %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// proxiedConn is a connection accepted from a proxy, reporting the client
+// address the proxy passed on.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c proxiedConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestProxyProtocol tests that the address from a PROXY header replaces the
+// proxy's own, including for ban checks, and that bad headers are refused.
+func TestProxyProtocol(t *testing.T) {
+	banlist := filepath.Join(t.TempDir(), "banlist.txt")
+	if err := os.WriteFile(banlist, []byte("203.0.113.66\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startTestServer(t, func(s *Server) {
+		s.ProxyProtocol = true
+		s.BanFile = banlist
+		if err := s.LoadFiles(); err != nil {
+			t.Fatalf("LoadFiles: %v", err)
+		}
+	})
+
+	admin := dialClient(t, addr)
+	admin.conn.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 8989\r\n"))
+	admin.send("Admin")
+	admin.expect("Admin joined the chat")
+	admin.send("/whois Admin")
+	admin.expect("address=203.0.113.7:56324")
+
+	banned := dialClient(t, addr)
+	banned.conn.Write([]byte("PROXY TCP4 203.0.113.66 192.0.2.1 40000 8989\r\n"))
+	banned.expect("disconnected: banned")
+	banned.expectClosed()
+
+	bad := dialClient(t, addr)
+	bad.send("Mallory")
+	bad.expect("disconnected: invalid PROXY header")
+	bad.expectClosed()
+}
+
+// TestReadProxyHeaderUnknown tests that "PROXY UNKNOWN" keeps the
+// connection's own address.
+func TestReadProxyHeaderUnknown(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.ProxyProtocol = true
+	})
+	c := dialClient(t, addr)
+	c.conn.Write([]byte("PROXY UNKNOWN\r\n"))
+	c.send("Alice")
+	c.expect("Alice joined the chat")
+	c.send("/whois Alice")
+	c.expect("address=127.0.0.1:")
+}
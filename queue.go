@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// queuedConn is a connection waiting for a slot. Only its own goroutine
+// writes to it, so the queue can advance under ClientsLock without a peer
+// that has stopped reading holding everyone else up.
+type queuedConn struct {
+	conn     net.Conn
+	position chan int // its latest place in the queue; 0 once it has a slot
+}
+
+// tell hands q its new position, replacing one it hasn't written yet.
+// Callers hold ClientsLock, so nothing else sends on q.position meanwhile.
+func (q queuedConn) tell(position int) {
+	select {
+	case <-q.position:
+	default:
+	}
+	q.position <- position
+}
+
+// enqueueConn holds conn until a slot frees up. Callers hold ClientsLock,
+// and pass the entry to waitInQueue once they have released it.
+func (s *Server) enqueueConn(conn net.Conn) queuedConn {
+	q := queuedConn{conn: conn, position: make(chan int, 1)}
+	s.queue = append(s.queue, q)
+	q.tell(len(s.queue))
+	return q
+}
+
+// waitInQueue tells q's connection its place in the queue as it changes,
+// and runs the join flow once a slot frees, telling it with SlotMessage.
+// It gives up if the server shuts down, which closes the connection.
+func (s *Server) waitInQueue(q queuedConn) {
+	notice := "You are #%d in the queue.\n"
+	for {
+		select {
+		case position := <-q.position:
+			if position == 0 {
+				if s.SlotMessage != "" {
+					q.conn.Write([]byte(s.Format.Info(s.SlotMessage)))
+				}
+				s.runClient(q.conn)
+				return
+			}
+			s.reply(q.conn, fmt.Sprintf(notice, position))
+			notice = "You are now #%d in the queue.\n"
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// promoteQueued gives a free slot to the first queued connection and tells
+// the rest their new position. Callers hold ClientsLock; the connections'
+// own goroutines do the writing.
+func (s *Server) promoteQueued() {
+	if s.closed || len(s.queue) == 0 || len(s.Clients) >= s.MaxClients {
+		return
+	}
+	s.queue[0].tell(0)
+	s.queue = s.queue[1:]
+	for i, q := range s.queue {
+		q.tell(i + 1)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// TestQueuePromotion tests that a connection queued while the server is
+// full joins once a slot frees, and that a full queue rejects.
+func TestQueuePromotion(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.MaxClients = 1
+		s.QueueSize = 1
+	})
+	alice := joinClient(t, addr, "Alice")
+
+	bob := dialClient(t, addr)
+	bob.expect("You are #1 in the queue.")
+
+	carol := dialClient(t, addr)
+	carol.expect(DefaultFullMessage)
+	carol.expect("disconnected: server full")
+	carol.expectClosed()
+
+	bob.send("Bob") // typed while waiting; read once promoted
+	alice.send("/exit")
+	bob.expect("Bob joined the chat")
+}
+
+// TestQueuePositions tests that queued connections are told their new
+// position as the queue advances, and the promoted one that it got in.
+func TestQueuePositions(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.MaxClients = 1
+		s.QueueSize = 3
+	})
+	alice := joinClient(t, addr, "Alice")
+
+	queued := make([]*testClient, 3)
+	for i := range queued {
+		queued[i] = dialClient(t, addr)
+		queued[i].expect(fmt.Sprintf("You are #%d in the queue.", i+1))
+	}
+
+	alice.send("/exit")
+	queued[0].expect("[INFO]: " + DefaultSlotMessage)
+	queued[1].expect("You are now #1 in the queue.")
+	queued[2].expect("You are now #2 in the queue.")
+
+	queued[0].send("Bob")
+	queued[0].expect("Bob joined the chat")
+	queued[0].send("/exit")
+	queued[1].expect("[INFO]: " + DefaultSlotMessage)
+	queued[2].expect("You are now #1 in the queue.")
+}
+
+// TestQueueStalledPeer tests that a queued connection that has stopped
+// reading doesn't hold up the queue or the chat.
+func TestQueueStalledPeer(t *testing.T) {
+	server, addr := startTestServer(t, func(s *Server) {
+		s.MaxClients = 2
+		s.QueueSize = 2
+	})
+	alice := joinClient(t, addr, "Alice")
+	dave := joinClient(t, addr, "Dave")
+
+	// Writes to stalled block, as nothing reads from peer.
+	stalled, peer := net.Pipe()
+	defer peer.Close()
+	server.ClientsLock.Lock()
+	q := server.enqueueConn(stalled)
+	server.ClientsLock.Unlock()
+	go server.waitInQueue(q)
+
+	bob := dialClient(t, addr)
+	bob.expect("You are #2 in the queue.")
+	dave.send("/exit")
+	alice.expect("Dave left the chat")
+	bob.expect("You are now #1 in the queue.")
+}
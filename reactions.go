@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MaxReactionLen   = 16 // longest reaction, in bytes
+	MaxReactionKinds = 20 // different reactions one message can have
+)
+
+// react handles /react <seq> <emoji>. Each user can add a given reaction
+// to a message once.
+func (s *Server) react(client *Client, args string) {
+	seqArg, emoji, _ := strings.Cut(args, " ")
+	emoji = strings.TrimSpace(emoji)
+	seq, err := strconv.Atoi(strings.TrimPrefix(seqArg, "#"))
+	if err != nil || emoji == "" || len(emoji) > MaxReactionLen || strings.ContainsAny(emoji, " \t") {
+		s.reply(client.Conn, fmt.Sprintf("Usage: /react <seq> <emoji> (up to %d bytes)\n", MaxReactionLen))
+		return
+	}
+	room := s.clientRoom(client)
+	who := foldName(client.Username)
+
+	s.MsgLock.Lock()
+	msg := s.visibleMessage(seq, room)
+	switch {
+	case msg == nil:
+		s.MsgLock.Unlock()
+		s.reply(client.Conn, fmt.Sprintf("No message #%d in history.\n", seq))
+		return
+	case slices.Contains(msg.Reactions[emoji], who):
+		s.MsgLock.Unlock()
+		s.reply(client.Conn, fmt.Sprintf("You already reacted %s to #%d.\n", emoji, seq))
+		return
+	case msg.Reactions[emoji] == nil && len(msg.Reactions) >= MaxReactionKinds:
+		s.MsgLock.Unlock()
+		s.reply(client.Conn, fmt.Sprintf("#%d already has %d kinds of reactions.\n", seq, MaxReactionKinds))
+		return
+	}
+	// Copies of the message, such as an /export in progress, share the old
+	// map, so it is replaced rather than changed.
+	reactions := make(map[string][]string, len(msg.Reactions)+1)
+	for e, names := range msg.Reactions {
+		reactions[e] = names
+	}
+	reactions[emoji] = append(slices.Clip(msg.Reactions[emoji]), who)
+	msg.Reactions = reactions
+	s.saveMessage(*msg)
+	s.MsgLock.Unlock()
+
+	s.roomNotice(room, fmt.Sprintf("%s reacted %s to #%d", client.Username, emoji, seq), "", client.Username)
+}
+
+// listReactions handles /reactions <seq>.
+func (s *Server) listReactions(client *Client, args string) {
+	seq, err := strconv.Atoi(strings.TrimPrefix(args, "#"))
+	if err != nil {
+		s.reply(client.Conn, "Usage: /reactions <seq>\n")
+		return
+	}
+	room := s.clientRoom(client)
+
+	s.MsgLock.Lock()
+	msg := s.visibleMessage(seq, room)
+	if msg == nil {
+		s.MsgLock.Unlock()
+		s.reply(client.Conn, fmt.Sprintf("No message #%d in history.\n", seq))
+		return
+	}
+	parts := make([]string, 0, len(msg.Reactions))
+	for emoji, who := range msg.Reactions {
+		parts = append(parts, fmt.Sprintf("%s %d", emoji, len(who)))
+	}
+	s.MsgLock.Unlock()
+
+	if len(parts) == 0 {
+		s.reply(client.Conn, fmt.Sprintf("No reactions to #%d.\n", seq))
+		return
+	}
+	sort.Strings(parts)
+	s.reply(client.Conn, fmt.Sprintf("Reactions to #%d: %s\n", seq, strings.Join(parts, ", ")))
+}
+
+// visibleMessage returns the stored message numbered seq if it can be seen
+// from room, or nil. Callers hold MsgLock.
+func (s *Server) visibleMessage(seq int, room string) *Message {
+	for i := len(s.Messages) - 1; i >= 0; i-- {
+		if s.Messages[i].Seq == seq {
+			if s.Messages[i].Kind == KindPrivate || !visibleIn(s.Messages[i], room) {
+				return nil
+			}
+			return &s.Messages[i]
+		}
+	}
+	return nil
+}
+
+// clientRoom returns the room client is in.
+func (s *Server) clientRoom(client *Client) string {
+	s.ClientsLock.Lock()
+	defer s.ClientsLock.Unlock()
+	return client.Room
+}
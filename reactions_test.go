@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestReactions tests reacting to a message, refusing a duplicate reaction
+// and listing the reactions.
+func TestReactions(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("hello")
+	bob.expect("[Alice]: hello")
+
+	bob.send("/react 1")
+	bob.expect("Usage: /react <seq> <emoji>")
+	bob.send("/react 9 👍")
+	bob.expect("No message #9 in history.")
+	bob.send("/reactions 1")
+	bob.expect("No reactions to #1.")
+
+	bob.send("/react 1 👍")
+	alice.expect("[INFO]: Bob reacted 👍 to #1")
+	bob.expect("[INFO]: Bob reacted 👍 to #1")
+	bob.send("/react #1 👍")
+	bob.expect("You already reacted 👍 to #1.")
+	alice.send("/react 1 👍")
+	bob.expect("[INFO]: Alice reacted 👍 to #1")
+	alice.send("/react 1 🎉")
+	bob.expect("[INFO]: Alice reacted 🎉 to #1")
+
+	bob.send("/reactions 1")
+	bob.expect("Reactions to #1: 🎉 1, 👍 2")
+
+	// Messages in other rooms can't be reacted to.
+	bob.send("/join dev")
+	bob.expect("You joined #dev.")
+	bob.send("/react 1 👀")
+	bob.expect("No message #1 in history.")
+}
+
+// TestReactionsPersisted tests that a reaction is appended to the history
+// file without dropping messages outside the -hmax replay window.
+func TestReactionsPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl.gz")
+	server, addr := startTestServer(t, func(s *Server) {
+		s.HistoryFile = path
+		s.HistoryMax = 2
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+
+	for _, text := range []string{"one", "two", "three", "four"} {
+		alice.send(text)
+		bob.expect(text)
+	}
+	bob.send("/react 4 x")
+	alice.expect("Bob reacted x to #4")
+
+	saved, err := readHistory(path)
+	if err != nil {
+		t.Fatalf("readHistory: %v", err)
+	}
+	if got := contents(saved); got != "one two three four" {
+		t.Fatalf("History file holds %q, want all four messages", got)
+	}
+	if who := saved[3].Reactions["x"]; len(who) != 1 || who[0] != "bob" {
+		t.Errorf("Saved reactions to #4: %v", saved[3].Reactions)
+	}
+
+	restarted := newTestServer(t, TCP, "0")
+	defer restarted.Shutdown()
+	restarted.HistoryFile = path
+	restarted.HistoryMax = server.HistoryMax
+	if err := restarted.LoadHistory(); err != nil {
+		t.Fatalf("LoadHistory: %v", err)
+	}
+	if got := contents(restarted.Messages); got != "three four" {
+		t.Errorf("Restored %q, want \"three four\"", got)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// LoadFiles reads the MOTD, logos, banlist and allowlist files the server
+// is configured with. Unlike Reload, it fails on the first invalid file.
+func (s *Server) LoadFiles() error {
+	motd, err := readTextFile(s.MOTDFile)
+	if err != nil {
+		return err
+	}
+	logo, err := readTextFile(s.LogoFile)
+	if err != nil {
+		return err
+	}
+	wsLogo, err := readTextFile(s.WSLogoFile)
+	if err != nil {
+		return err
+	}
+	banned, err := readAddrList(s.BanFile)
+	if err != nil {
+		return err
+	}
+	allowed, err := readAddrList(s.AllowFile)
+	if err != nil {
+		return err
+	}
+
+	s.ReloadLock.Lock()
+	s.motd, s.logo, s.wsLogo, s.banned, s.allowed = motd, logo, wsLogo, banned, allowed
+	s.ReloadLock.Unlock()
+	return nil
+}
+
+// Reload re-reads the file-backed settings without touching connected
+// clients. A file that can't be read or parsed is logged and its previous
+// contents are kept.
+func (s *Server) Reload() {
+	s.ReloadLock.Lock()
+	defer s.ReloadLock.Unlock()
+
+	if motd, err := readTextFile(s.MOTDFile); err != nil {
+		log.Printf("Keeping old MOTD: %v", err)
+	} else if motd != s.motd {
+		s.motd = motd
+		s.logActivity("Reloaded MOTD.")
+	}
+	if logo, err := readTextFile(s.LogoFile); err != nil {
+		log.Printf("Keeping old logo: %v", err)
+	} else if logo != s.logo {
+		s.logo = logo
+		s.logActivity("Reloaded logo.")
+	}
+	if wsLogo, err := readTextFile(s.WSLogoFile); err != nil {
+		log.Printf("Keeping old WebSocket logo: %v", err)
+	} else if wsLogo != s.wsLogo {
+		s.wsLogo = wsLogo
+		s.logActivity("Reloaded WebSocket logo.")
+	}
+	if banned, err := readAddrList(s.BanFile); err != nil {
+		log.Printf("Keeping old banlist: %v", err)
+	} else if added, removed := diffAddrs(s.banned, banned); added+removed > 0 {
+		s.banned = banned
+		s.logActivity(fmt.Sprintf("Reloaded banlist: %d added, %d removed.", added, removed))
+	}
+	if allowed, err := readAddrList(s.AllowFile); err != nil {
+		log.Printf("Keeping old allowlist: %v", err)
+	} else if added, removed := diffAddrs(s.allowed, allowed); added+removed > 0 {
+		s.allowed = allowed
+		s.logActivity(fmt.Sprintf("Reloaded allowlist: %d added, %d removed.", added, removed))
+	}
+}
+
+// currentLogo returns the logo shown to new connections. NoLogo wins over
+// LogoFile.
+func (s *Server) currentLogo() string {
+	if s.NoLogo {
+		return ""
+	}
+	s.ReloadLock.Lock()
+	defer s.ReloadLock.Unlock()
+	if s.LogoFile == "" {
+		return LinuxLogo
+	}
+	return s.logo
+}
+
+// logoFor returns the logo shown to conn: WebSocket clients get WSLogoFile
+// when it is set, since browsers may not render ASCII art as a terminal
+// does. NoLogo wins over both.
+func (s *Server) logoFor(conn net.Conn) string {
+	if counting, ok := conn.(*countingConn); ok {
+		conn = counting.Conn
+	}
+	if _, ok := conn.(*wsConn); !ok || s.WSLogoFile == "" || s.NoLogo {
+		return s.currentLogo()
+	}
+	s.ReloadLock.Lock()
+	defer s.ReloadLock.Unlock()
+	return s.wsLogo
+}
+
+// sendMOTD sends the message of the day, if any, to a client that just
+// joined.
+func (s *Server) sendMOTD(client *Client) {
+	s.ReloadLock.Lock()
+	motd := s.motd
+	s.ReloadLock.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(motd, "\n"), "\n") {
+		if line != "" {
+			client.Conn.Write([]byte(s.Format.Info(line)))
+		}
+	}
+}
+
+// admitted reports why conn may not join, or "" if it may. Connections
+// from banned addresses, or from addresses missing from a non-empty
+// allowlist, are refused.
+func (s *Server) admitted(conn net.Conn) string {
+	host := remoteHost(conn)
+
+	s.ReloadLock.Lock()
+	defer s.ReloadLock.Unlock()
+	if s.banned[host] {
+		return "banned"
+	}
+	if len(s.allowed) > 0 && !s.allowed[host] {
+		return "not on the allowlist"
+	}
+	return ""
+}
+
+// readTextFile returns the contents of path, or "" if path is empty.
+func readTextFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("%s: not valid UTF-8", path)
+	}
+	return string(data), nil
+}
+
+// readAddrList reads one IP address per line from path. Blank lines and
+// lines starting with '#' are ignored.
+func readAddrList(path string) (map[string]bool, error) {
+	addrs := make(map[string]bool)
+	if path == "" {
+		return addrs, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ip := net.ParseIP(line)
+		if ip == nil {
+			return nil, fmt.Errorf("%s:%d: invalid IP address %q", path, lineNo, line)
+		}
+		addrs[ip.String()] = true
+	}
+	return addrs, scanner.Err()
+}
+
+// diffAddrs counts the addresses added to and removed from old in new.
+func diffAddrs(old, new map[string]bool) (added, removed int) {
+	for addr := range new {
+		if !old[addr] {
+			added++
+		}
+	}
+	for addr := range old {
+		if !new[addr] {
+			removed++
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestReloadMOTD tests that Reload picks up an edited MOTD for new joiners
+// and keeps the old one when the file becomes unreadable.
+func TestReloadMOTD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "motd.txt")
+	if err := os.WriteFile(path, []byte("Welcome!\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, addr := startTestServer(t, func(s *Server) {
+		s.MOTDFile = path
+		if err := s.LoadFiles(); err != nil {
+			t.Fatalf("LoadFiles: %v", err)
+		}
+	})
+
+	alice := dialClient(t, addr)
+	alice.send("Alice")
+	alice.expect("[INFO]: Welcome!")
+
+	if err := os.WriteFile(path, []byte("Be nice.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server.Reload()
+	bob := dialClient(t, addr)
+	bob.send("Bob")
+	bob.expect("[INFO]: Be nice.")
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	server.Reload()
+	carol := dialClient(t, addr)
+	carol.send("Carol")
+	carol.expect("[INFO]: Be nice.")
+	alice.expectNone("Be nice.")
+}
+
+// TestReloadBanlist tests that a reloaded banlist refuses new connections
+// and that an invalid one is ignored.
+func TestReloadBanlist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "banlist.txt")
+	if err := os.WriteFile(path, []byte("# nobody yet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, addr := startTestServer(t, func(s *Server) {
+		s.BanFile = path
+	})
+	alice := joinClient(t, addr, "Alice")
+
+	if err := os.WriteFile(path, []byte("127.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server.Reload()
+	banned := dialClient(t, addr)
+	banned.expect("disconnected: banned")
+	banned.expectClosed()
+	alice.expectNone("left the chat")
+
+	if err := os.WriteFile(path, []byte("not-an-address\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server.Reload()
+	again := dialClient(t, addr)
+	again.expect("disconnected: banned")
+}
+
+// TestNoLogo tests that -nologo sends the name prompt first.
+func TestNoLogo(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.NoLogo = true
+	})
+	c := dialClient(t, addr)
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	prompt := make([]byte, len("Enter your name: "))
+	if _, err := io.ReadFull(c.reader, prompt); err != nil {
+		t.Fatalf("Failed to read the prompt: %v", err)
+	}
+	if string(prompt) != "Enter your name: " {
+		t.Errorf("Got %q before the prompt", prompt)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// ReportInterval is how long a client must wait between /report commands.
+const ReportInterval = 30 * time.Second
+
+// report handles /report <user> [reason]. The report goes to the audit log
+// and to every connected admin.
+func (s *Server) report(client *Client, args string) {
+	target, reason, _ := strings.Cut(args, " ")
+	reason = strings.TrimSpace(reason)
+	if target == "" {
+		s.reply(client.Conn, "Usage: /report <user> [reason]\n")
+		return
+	}
+	if wait := client.LastReport.Add(ReportInterval).Sub(time.Now()); wait > 0 {
+		s.reply(client.Conn, fmt.Sprintf("You can report again in %ds.\n", int(math.Ceil(wait.Seconds()))))
+		return
+	}
+	if reason == "" {
+		reason = "no reason given"
+	}
+
+	s.ClientsLock.Lock()
+	other := s.findClient(target)
+	if other == nil {
+		s.ClientsLock.Unlock()
+		s.reply(client.Conn, fmt.Sprintf("%s is not online.\n", target))
+		return
+	}
+	target = other.Username
+	notice := s.Format.Info(fmt.Sprintf("%s reported %s: %s", client.Username, target, reason))
+	for _, admin := range s.Clients {
+		if admin.Admin && admin != client {
+			s.enqueue(admin, notice)
+		}
+	}
+	s.ClientsLock.Unlock()
+
+	client.LastReport = time.Now()
+	s.logActivity(fmt.Sprintf("Client %s reported %s: %s", client.Username, target, reason))
+	s.reply(client.Conn, "Thanks, your report was recorded.\n")
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+// TestReport tests that a report reaches the admin and the audit log, and
+// that reports are rate-limited.
+func TestReport(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+	joinClient(t, addr, "Mallory")
+
+	bob.send("/report nobody")
+	bob.expect("nobody is not online.")
+
+	bob.send("/report mallory spamming links")
+	bob.expect("Thanks, your report was recorded.")
+	admin.expect("[INFO]: Bob reported Mallory: spamming links")
+
+	bob.send("/report Mallory again")
+	bob.expect("You can report again in 30s.")
+	admin.expectNone("reported Mallory: again")
+
+	admin.send("/audit 1")
+	admin.expect("Client Bob reported Mallory: spamming links")
+}
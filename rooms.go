@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultRoom is the room clients are in when they join.
+const DefaultRoom = "general"
+
+// MaxRoomNameLen is the longest room name /join accepts.
+const MaxRoomNameLen = 32
+
+const (
+	DefaultMaxRooms = 100
+	DefaultRoomIdle = 10 * time.Minute
+)
+
+// Room is a channel of conversation. Chat messages only reach clients in
+// the same room; announcements and join/leave notices reach everyone.
+type Room struct {
+	Name       string
+	Created    time.Time
+	EmptySince time.Time // when the janitor first found the room empty; zero if occupied
+}
+
+// ensureRoom returns the room called name, creating it if needed. Callers
+// hold ClientsLock.
+func (s *Server) ensureRoom(name string) *Room {
+	room, ok := s.rooms[name]
+	if !ok {
+		room = &Room{Name: name, Created: time.Now()}
+		s.rooms[name] = room
+	}
+	return room
+}
+
+// validRoomName reports whether name can be used with /join.
+func validRoomName(name string) bool {
+	return name != "" && len(name) <= MaxRoomNameLen && !strings.ContainsAny(name, " \t#")
+}
+
+// visibleIn reports whether msg belongs in room's history. Announcements
+// are shown in every room, and messages stored before rooms existed are in
+// DefaultRoom.
+func visibleIn(msg Message, room string) bool {
+	if msg.Kind == KindAnnouncement {
+		return true
+	}
+	if msg.Room == "" {
+		return room == DefaultRoom
+	}
+	return msg.Room == room
+}
+
+// replayHistory sends client the stored messages of room.
+func (s *Server) replayHistory(client *Client, room string) {
+	s.MsgLock.Lock()
+	defer s.MsgLock.Unlock()
+	for _, msg := range s.Messages {
+		if !visibleIn(msg, room) {
+			continue
+		}
+		if _, err := client.Conn.Write([]byte(s.formatMessageFor(client, msg))); err != nil {
+			return // the read loop will see the dead connection and clean up
+		}
+	}
+}
+
+// joinRoom handles /join <room>, moving client to room (creating it if
+// needed) and replaying that room's history.
+func (s *Server) joinRoom(client *Client, name string) {
+	name = strings.ToLower(strings.TrimPrefix(name, "#"))
+	if !validRoomName(name) {
+		s.reply(client.Conn, fmt.Sprintf("Usage: /join <room> (up to %d characters, no spaces)\n", MaxRoomNameLen))
+		return
+	}
+
+	s.ClientsLock.Lock()
+	old := client.Room
+	if old == name {
+		s.ClientsLock.Unlock()
+		s.reply(client.Conn, fmt.Sprintf("You are already in #%s.\n", name))
+		return
+	}
+	if _, exists := s.rooms[name]; !exists && s.MaxRooms > 0 && len(s.rooms) >= s.MaxRooms {
+		s.ClientsLock.Unlock()
+		s.reply(client.Conn, "Room limit reached.\n")
+		return
+	}
+	s.ensureRoom(name)
+	client.Room = name
+	s.ClientsLock.Unlock()
+
+	s.roomNotice(old, fmt.Sprintf("%s left #%s", client.Username, old), client.Username, "")
+	s.roomNotice(name, fmt.Sprintf("%s joined #%s", client.Username, name), client.Username, "")
+	s.reply(client.Conn, fmt.Sprintf("You joined #%s.\n", name))
+	s.replayHistory(client, name)
+}
+
+// listRooms handles /rooms.
+func (s *Server) listRooms(client *Client) {
+	s.ClientsLock.Lock()
+	counts := make(map[string]int, len(s.rooms))
+	for name := range s.rooms {
+		counts[name] = 0
+	}
+	for _, other := range s.Clients {
+		counts[other.Room]++
+	}
+	current := client.Room
+	s.ClientsLock.Unlock()
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		marker := ""
+		if name == current {
+			marker = " (you are here)"
+		}
+		fmt.Fprintf(&b, "#%s: %d online%s\n", name, counts[name], marker)
+	}
+	s.reply(client.Conn, b.String())
+}
+
+// cleanRooms removes rooms that have been empty for RoomIdle, checking
+// every half RoomIdle until the server shuts down. DefaultRoom is kept.
+func (s *Server) cleanRooms() {
+	ticker := time.NewTicker(s.RoomIdle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		s.ClientsLock.Lock()
+		occupied := make(map[string]bool, len(s.rooms))
+		for _, client := range s.Clients {
+			occupied[client.Room] = true
+		}
+		for name, room := range s.rooms {
+			switch {
+			case name == DefaultRoom || occupied[name]:
+				room.EmptySince = time.Time{}
+			case room.EmptySince.IsZero():
+				room.EmptySince = now
+			case now.Sub(room.EmptySince) >= s.RoomIdle:
+				delete(s.rooms, name)
+				log.Printf("Removed idle room #%s.", name)
+			}
+		}
+		s.ClientsLock.Unlock()
+	}
+}
+
+// roomNotice sends an info line to everyone in room except sender and
+// those ignoring author.
+func (s *Server) roomNotice(room, text, sender, author string) {
+	s.roomSend(room, s.Format.Info(text), sender, author)
+}
+
+// roomSend sends a formatted line to everyone in room except sender and,
+// like broadcast, those ignoring author, the user the line is about. Either
+// may be empty.
+func (s *Server) roomSend(room, message, sender, author string) {
+	s.ClientsLock.Lock()
+	defer s.ClientsLock.Unlock()
+	for _, client := range s.Clients {
+		if client.Room == room && client.Username != sender && !client.Ignored[foldName(author)] {
+			s.enqueue(client, message)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRooms tests that chat messages stay in their room while joins and
+// announcements reach everyone.
+func TestRooms(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("/join Dev")
+	alice.expect("You joined #dev.")
+	bob.send("/join #dev")
+	bob.expect("You joined #dev.")
+	alice.expect("Bob joined #dev")
+
+	alice.send("in dev")
+	bob.expect("in dev")
+	admin.expectNone("in dev")
+
+	admin.send("in general")
+	alice.expectNone("in general")
+
+	admin.send("/announce maintenance soon")
+	alice.expect("maintenance soon")
+
+	alice.send("/rooms")
+	alice.expect("#dev: 2 online (you are here)")
+	alice.expect("#general: 1 online")
+}
+
+// TestRoomHistoryPersists tests that a room's history is restored from the
+// history file after a restart, including the room itself.
+func TestRoomHistoryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	_, addr := startTestServer(t, func(s *Server) {
+		s.HistoryFile = path
+	})
+	alice := joinClient(t, addr, "Alice")
+	alice.send("/join dev")
+	alice.expect("You joined #dev.")
+	alice.send("dev talk")
+	alice.send("/join general")
+	alice.expect("You joined #general.")
+	alice.send("general talk")
+	alice.send("/whoami") // wait for the messages to be stored
+	alice.expect("You are Alice")
+
+	_, addr = startTestServer(t, func(s *Server) {
+		s.HistoryFile = path
+		if err := s.LoadHistory(); err != nil {
+			t.Fatalf("LoadHistory: %v", err)
+		}
+		if s.rooms["dev"] == nil {
+			t.Error("Room dev was not recreated from the history")
+		}
+	})
+	bob := dialClient(t, addr)
+	bob.send("Bob")
+	for line := bob.next(); !strings.Contains(line, "general talk"); line = bob.next() {
+		if strings.Contains(line, "dev talk") {
+			t.Fatalf("#dev history replayed in #general: %q", line)
+		}
+	}
+	bob.send("/join dev")
+	bob.expect("You joined #dev.")
+	bob.expect("dev talk")
+	bob.expectNone("general talk")
+}
+
+// TestRoomLimit tests that /join can't create rooms past MaxRooms, while
+// existing rooms can still be joined.
+func TestRoomLimit(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) { s.MaxRooms = 2 })
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("/join dev")
+	alice.expect("You joined #dev.")
+	bob.send("/join ops")
+	bob.expect("Room limit reached.")
+	bob.send("/join dev")
+	bob.expect("You joined #dev.")
+}
+
+// TestIdleRoomRemoved tests that a room is removed once it has been empty
+// for RoomIdle, and that the default room stays.
+func TestIdleRoomRemoved(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) { s.RoomIdle = 100 * time.Millisecond })
+	alice := joinClient(t, addr, "Alice")
+
+	alice.send("/join dev")
+	alice.expect("You joined #dev.")
+	alice.send("/join general")
+	alice.expect("You joined #general.")
+
+	time.Sleep(300 * time.Millisecond)
+	alice.send("/rooms")
+	alice.expect("#general: 1 online (you are here)")
+	alice.expectNone("#dev")
+}
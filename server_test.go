@@ -2,15 +2,22 @@ package main
 
 import (
 	"bufio"
+	"fmt"
+	"io"
 	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 // TestTCPServer tests the TCP chat server's basic functionality.
 func TestTCPServer(t *testing.T) {
 	// Start the server in a separate goroutine
-	server := NewServer(TCP, "9000")
+	server := newTestServer(t, TCP, "9000")
 	go server.Start()
 
 	// Allow time for the server to start
@@ -70,7 +77,7 @@ func TestTCPServer(t *testing.T) {
 // TestUDPServer tests the UDP message receipt functionality.
 func TestUDPServer(t *testing.T) {
 	// Start the server in a separate goroutine
-	server := NewServer(UDP, "9001")
+	server := newTestServer(t, UDP, "9001")
 	go server.startUDP()
 
 	// Allow time for the server to start
@@ -91,4 +98,1561 @@ func TestUDPServer(t *testing.T) {
 
 	// Shutdown the server after test
 	server.Shutdown()
-}
\ No newline at end of file
+}
+
+// newTestServer creates a server for protocol on port, like NewServer, but
+// with its log under a temporary directory rather than in the package.
+func newTestServer(t testing.TB, protocol Protocol, port string) *Server {
+	t.Helper()
+	return NewServerWithOptions(WithProtocol(protocol), WithPort(port),
+		WithLogFile(filepath.Join(t.TempDir(), "server.log"), 0, 0))
+}
+
+// startTestServer runs a TCP server on a free local port and returns it
+// along with its address. The configure functions run before it serves.
+func startTestServer(t *testing.T, configure ...func(*Server)) (*Server, string) {
+	t.Helper()
+	server := newTestServer(t, TCP, "0")
+	for _, f := range configure {
+		f(server)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.serveTCP(listener)
+	t.Cleanup(server.Shutdown)
+	return server, listener.Addr().String()
+}
+
+// testClient is a chat client used by the tests.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialClient connects to addr without sending a name.
+func dialClient(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// joinClient connects to addr as name and waits until the join is announced.
+func joinClient(t *testing.T, addr, name string) *testClient {
+	t.Helper()
+	c := dialClient(t, addr)
+	c.send(name)
+	c.expect(name + " joined the chat")
+	return c
+}
+
+// send writes a line to the server.
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatalf("Failed to send %q: %v", line, err)
+	}
+}
+
+// expect reads lines until one contains want and returns it.
+func (c *testClient) expect(want string) string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	for {
+		line, err := c.reader.ReadString('\n')
+		if strings.Contains(line, want) {
+			return line
+		}
+		if err != nil {
+			c.t.Fatalf("Did not receive %q: %v", want, err)
+		}
+	}
+}
+
+// next returns the next line from the server.
+func (c *testClient) next() string {
+	c.t.Helper()
+	return c.expect("")
+}
+
+// expectNone fails if a line containing unwanted arrives within a short wait.
+func (c *testClient) expectNone(unwanted string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	defer c.conn.SetReadDeadline(time.Time{})
+	for {
+		line, err := c.reader.ReadString('\n')
+		if strings.Contains(line, unwanted) {
+			c.t.Fatalf("Unexpectedly received %q", line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// expectClosed fails unless the server closes the connection.
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if line, err := c.reader.ReadString('\n'); err == nil {
+		c.t.Fatalf("Expected the connection to be closed, got %q", line)
+	}
+}
+
+// TestStatsReset tests that an admin can zero the message counters.
+func TestStatsReset(t *testing.T) {
+	server, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	user := joinClient(t, addr, "User")
+
+	admin.send("hello")
+	user.expect("hello")
+	user.send("/stats")
+	user.expect("clients=2 peak=2 messages=1 bytes=5")
+
+	user.send("/stats reset")
+	user.expect("Only admins can reset stats.")
+
+	admin.send("/stats reset")
+	admin.expect("Stats reset.")
+	admin.send("/stats")
+	admin.expect("clients=2 peak=2 messages=0 bytes=0")
+
+	server.StatsLock.Lock()
+	defer server.StatsLock.Unlock()
+	if server.Stats.TotalMessages != 0 || server.Stats.TotalBytes != 0 {
+		t.Errorf("Counters not reset: %+v", server.Stats)
+	}
+}
+
+// TestNameRetrySucceeds tests that a client can pick a new name after an
+// invalid one.
+func TestNameRetrySucceeds(t *testing.T) {
+	_, addr := startTestServer(t)
+	joinClient(t, addr, "Alice")
+
+	c := dialClient(t, addr)
+	c.send("Alice")
+	c.expect("Username already taken.")
+	c.send("Bob")
+	c.expect("Bob joined the chat")
+}
+
+// TestNameRetriesExhausted tests that a client is disconnected after too
+// many invalid names.
+func TestNameRetriesExhausted(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.NameRetries = 1
+	})
+
+	c := dialClient(t, addr)
+	c.send("")
+	c.expect("Invalid username.")
+	c.send("")
+	c.expect("Too many invalid attempts.")
+	c.expect("[INFO]: disconnected: too many invalid attempts")
+	c.expectClosed()
+}
+
+// TestControlCharsInName tests that names holding a carriage return or an
+// ANSI escape are refused, at the prompt and by /name.
+func TestControlCharsInName(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+
+	c := dialClient(t, addr)
+	c.send("Bob\r[INFO]: Mallory is now an admin")
+	c.expect("Invalid username.")
+	c.send("\x1b[31mBob")
+	c.expect("Invalid username.")
+	c.send("Bob")
+	alice.expect("[INFO]: Bob joined the chat")
+
+	c.send("/name Bob\x1b[2J")
+	c.expect("Invalid new name.")
+	alice.expectNone("changed their name")
+}
+
+// TestSlowNameEntry tests that a name typed one byte at a time is only
+// used once its newline arrives.
+func TestSlowNameEntry(t *testing.T) {
+	server, addr := startTestServer(t)
+	c := dialClient(t, addr)
+	c.expect("|o_o |")
+	for _, b := range []byte("Slowpoke") {
+		if _, err := c.conn.Write([]byte{b}); err != nil {
+			t.Fatalf("Failed to send %q: %v", b, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		server.ClientsLock.Lock()
+		joined := len(server.Clients)
+		server.ClientsLock.Unlock()
+		if joined != 0 {
+			t.Fatalf("Joined before the newline was sent")
+		}
+	}
+	c.send("")
+	c.expect("Slowpoke joined the chat")
+}
+
+// TestNameTimeout tests that a client still typing its name when
+// NameTimeout runs out is disconnected.
+func TestNameTimeout(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.NameTimeout = 200 * time.Millisecond
+	})
+	c := dialClient(t, addr)
+	c.conn.Write([]byte("Sl"))
+	time.Sleep(100 * time.Millisecond)
+	c.conn.Write([]byte("ow"))
+	c.expect("[INFO]: disconnected: name timeout")
+	c.expectClosed()
+}
+
+// TestShutdownWaitsForClients tests that Shutdown stops every client
+// goroutine, including clients that never picked a name. Run with -race.
+func TestShutdownWaitsForClients(t *testing.T) {
+	server, addr := startTestServer(t)
+
+	for i := 0; i < 20; i++ {
+		c := joinClient(t, addr, fmt.Sprintf("user%d", i))
+		if i%2 == 0 {
+			c.send("/exit")
+		} else {
+			c.conn.Close()
+		}
+	}
+
+	joinClient(t, addr, "Stayer")
+	dialClient(t, addr) // never sends a name
+
+	start := time.Now()
+	server.Shutdown()
+	if elapsed := time.Since(start); elapsed >= ShutdownTimeout {
+		t.Fatalf("Shutdown timed out after %v", elapsed)
+	}
+
+	server.ClientsLock.Lock()
+	defer server.ClientsLock.Unlock()
+	if len(server.Clients) != 0 || len(server.conns) != 0 {
+		t.Errorf("Clients left after shutdown: %d clients, %d conns", len(server.Clients), len(server.conns))
+	}
+}
+
+// TestSlowMode tests enabling slow mode, blocking a fast message and
+// disabling it again.
+func TestSlowMode(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	user := joinClient(t, addr, "User")
+
+	user.send("/slowmode 60")
+	user.expect("Only admins can set slow mode.")
+
+	admin.send("/slowmode 60")
+	user.expect("[INFO]: slow mode set to 60s")
+
+	user.send("one")
+	admin.expect("[User]: one")
+	user.send("two")
+	user.expect("Slow mode: wait 60s.")
+	admin.expectNone("two")
+
+	admin.send("/slowmode 0")
+	user.expect("[INFO]: slow mode disabled")
+	user.send("three")
+	admin.expect("[User]: three")
+}
+
+// TestTimestampTimeZone tests that timestamps are formatted in the
+// server's configured time zone.
+func TestTimestampTimeZone(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("Time zone data unavailable: %v", err)
+	}
+	server := newTestServer(t, TCP, "0")
+	defer server.Shutdown()
+	msg := Message{Timestamp: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), Client: "Alice", Content: "hi"}
+
+	server.Location = time.UTC
+	if got, want := server.formatMessage(msg), "[2024-01-02 15:04:05][Alice]: hi\n"; got != want {
+		t.Errorf("UTC: got %q, want %q", got, want)
+	}
+	server.Location = tokyo
+	if got, want := server.formatMessage(msg), "[2024-01-03 00:04:05][Alice]: hi\n"; got != want {
+		t.Errorf("Asia/Tokyo: got %q, want %q", got, want)
+	}
+}
+
+// TestDuplicateSuppression tests that a repeated message is only broadcast
+// once when -nodupes is set.
+func TestDuplicateSuppression(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.NoDupes = true
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("spam")
+	bob.expect("[Alice]: spam")
+	alice.send("spam")
+	alice.expect("Duplicate message suppressed.")
+	bob.expectNone("spam")
+
+	alice.send("not spam")
+	bob.expect("[Alice]: not spam")
+}
+
+// TestParseProtocol tests protocol parsing, which is case-insensitive.
+func TestParseProtocol(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Protocol
+		wantErr bool
+	}{
+		{"tcp", TCP, false},
+		{"udp", UDP, false},
+		{"Tcp", TCP, false},
+		{"UDP", UDP, false},
+		{"sctp", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseProtocol(tt.input)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseProtocol(%q) = %q, %v", tt.input, got, err)
+		}
+	}
+	if Protocol("Tcp").Valid() {
+		t.Error("Valid should only accept canonical lower-case names")
+	}
+}
+
+// TestIgnore tests that ignoring a user only hides their messages from the
+// client who ignored them.
+func TestIgnore(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	carol := joinClient(t, addr, "Carol")
+
+	alice.send("/ignore Bob")
+	alice.expect("You are now ignoring Bob.")
+	bob.send("hello")
+	carol.expect("[Bob]: hello")
+	alice.expectNone("[Bob]: hello")
+
+	alice.send("/unignore Bob")
+	alice.expect("You are no longer ignoring Bob.")
+	bob.send("again")
+	alice.expect("[Bob]: again")
+
+	alice.send("/ignore Alice")
+	alice.expect("You can't ignore yourself.")
+}
+
+// TestSeen tests /seen for online, departed and unknown users, matching
+// names without regard to case.
+func TestSeen(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("/seen Bob")
+	alice.expect("Bob is currently online.")
+	alice.send("/seen bob")
+	alice.expect("Bob is currently online.")
+
+	bob.send("/exit")
+	alice.expect("Bob left the chat")
+	alice.send("/seen Bob")
+	alice.expect("Bob was last seen")
+	alice.send("/seen BOB")
+	alice.expect("BOB was last seen")
+
+	alice.send("/seen Carol")
+	alice.expect("Carol has never been seen.")
+}
+
+// TestLastSeenBounded tests that the last-seen map never exceeds its cap.
+func TestLastSeenBounded(t *testing.T) {
+	server := newTestServer(t, TCP, "0")
+	defer server.Shutdown()
+	start := time.Now()
+	for i := 0; i <= MaxLastSeen; i++ {
+		server.recordSeen(fmt.Sprintf("user%d", i), start.Add(time.Duration(i)*time.Second))
+	}
+	if len(server.LastSeen) != MaxLastSeen {
+		t.Fatalf("Expected %d entries, got %d", MaxLastSeen, len(server.LastSeen))
+	}
+	if _, ok := server.LastSeen["user0"]; ok {
+		t.Error("Expected the oldest entry to be evicted")
+	}
+}
+
+// TestCustomFullMessage tests that clients past capacity get the configured
+// rejection message before being disconnected.
+func TestCustomFullMessage(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.FullMessage = "Full! Try chat2.example.com instead."
+		s.MaxClients = 2
+	})
+	for i := 0; i < 2; i++ {
+		joinClient(t, addr, fmt.Sprintf("user%d", i))
+	}
+
+	c := dialClient(t, addr)
+	c.expect("Full! Try chat2.example.com instead.")
+	c.expect("[INFO]: disconnected: server full")
+	c.expectClosed()
+}
+
+// TestPresenceBroadcast tests that the online count is announced after an
+// interval.
+func TestPresenceBroadcast(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Presence = 100 * time.Millisecond
+	})
+	alice := joinClient(t, addr, "Alice")
+	alice.expect("[INFO]: 1 users online")
+	joinClient(t, addr, "Bob")
+	alice.expect("[INFO]: 2 users online")
+	alice.expectNone("users online") // unchanged count isn't repeated
+}
+
+// TestDisconnectReasons tests that clients are told why they were
+// disconnected.
+func TestDisconnectReasons(t *testing.T) {
+	server, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	bob.send("/exit")
+	bob.expect("[INFO]: disconnected: left the chat")
+	bob.expectClosed()
+	alice.expect("Bob left the chat")
+
+	server.Shutdown()
+	alice.expect("[INFO]: disconnected: server shutting down")
+	alice.expectClosed()
+}
+
+// TestAnnounce tests that an admin announcement reaches everyone, including
+// the announcer, and is kept in history.
+func TestAnnounce(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("/announce hi")
+	alice.expect("Only admins can make announcements.")
+
+	admin.send("/announce Maintenance at noon")
+	for _, c := range []*testClient{admin, alice, bob} {
+		c.expect("[ANNOUNCEMENT]: Maintenance at noon")
+	}
+
+	carol := dialClient(t, addr)
+	carol.send("Carol")
+	carol.expect("[ANNOUNCEMENT]: Maintenance at noon")
+}
+
+// TestEarlyDisconnect tests that clients closing during the handshake leave
+// no state or goroutines behind.
+func TestEarlyDisconnect(t *testing.T) {
+	server, addr := startTestServer(t)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		server.ClientsLock.Lock()
+		conns, clients := len(server.conns), len(server.Clients)
+		server.ClientsLock.Unlock()
+		if conns == 0 && clients == 0 && runtime.NumGoroutine() <= before {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Leftover state: %d conns, %d clients, %d goroutines (was %d)",
+				conns, clients, runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestCaseInsensitiveTargets tests that /msg and /ignore find users
+// regardless of case while names keep their display case.
+func TestCaseInsensitiveTargets(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "alice")
+	bob := joinClient(t, addr, "Bob")
+	carol := joinClient(t, addr, "Carol")
+
+	bob.send("/msg ALICE hi there")
+	bob.expect("Message sent to alice.")
+	alice.expect("[PM from Bob]: hi there")
+	carol.expectNone("hi there")
+
+	alice.send("/ignore bOB")
+	alice.expect("You are now ignoring Bob.")
+	bob.send("hello")
+	carol.expect("[Bob]: hello")
+	alice.expectNone("[Bob]: hello")
+
+	bob.send("/msg alice psst")
+	bob.expect("Message sent to alice.")
+	alice.expectNone("psst")
+
+	dup := dialClient(t, addr)
+	dup.send("ALICE")
+	dup.expect("Username already taken.")
+
+	carol.send("/name BOB")
+	carol.expect("This name is already taken.")
+}
+
+// TestReply tests replying to an existing and a missing message.
+func TestReply(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Format = HumanFormatter{ShowSeq: true}
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("lunch?")
+	bob.expect("[#1][Alice]: lunch?")
+	bob.send("/reply 1 sure")
+	alice.expect("[#2][Bob → #1]: sure")
+
+	bob.send("/reply 42 hello?")
+	bob.expect("No message #42 in history.")
+	alice.expectNone("hello?")
+}
+
+// TestReplyGated tests that /reply is held to the same slow mode,
+// duplicate suppression and receipts as plain chat.
+func TestReplyGated(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.NoDupes = true
+		s.Confirm = true
+	})
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+	admin.expect("Bob joined the chat")
+
+	admin.send("lunch?")
+	bob.expect("[Admin]: lunch?")
+	bob.send("/reply 1 sure")
+	admin.expect("[Bob → #1]: sure")
+	bob.expect("✓")
+	bob.send("/reply 1 sure")
+	bob.expect("Duplicate message suppressed.")
+
+	admin.send("/slowmode 3600")
+	bob.expect("[INFO]: slow mode set to 3600s")
+	bob.send("/reply 1 flood")
+	bob.expect("Slow mode: wait")
+	admin.expectNone("flood")
+}
+
+// TestBufSize tests that a message filling the configured buffer arrives as
+// a single message.
+func TestBufSize(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.BufSize = MinBufSize
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	long := strings.Repeat("x", MinBufSize-1) // plus the newline
+	alice.send(long)
+	bob.expect("[Alice]: " + long + "\n")
+}
+
+// TestConnectionCounters tests that accepted and rejected connections are
+// counted.
+func TestConnectionCounters(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.MaxClients = 1
+	})
+	alice := joinClient(t, addr, "Alice")
+
+	for i := 0; i < 2; i++ {
+		c := dialClient(t, addr)
+		c.expect("disconnected: server full")
+	}
+
+	alice.send("/stats")
+	alice.expect("accepted=3 rejected=2")
+}
+
+// TestUnname tests that /unname restores the name a client joined with,
+// unless someone else has taken it.
+func TestUnname(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	alice := joinClient(t, addr, "Alice")
+
+	alice.send("/unname")
+	alice.expect("You already use your original name.")
+	alice.send("/name Alicia")
+	admin.expect("Alice changed their name to Alicia")
+	alice.send("/name Ally")
+	admin.expect("Alicia changed their name to Ally")
+	alice.send("/unname")
+	admin.expect("Ally changed their name to Alice")
+
+	alice.send("/name Ally")
+	admin.expect("Alice changed their name to Ally")
+	joinClient(t, addr, "Alice")
+	admin.expect("Alice joined the chat")
+	alice.send("/unname")
+	alice.expect("This name is already taken.")
+}
+
+// TestShowCapacity tests that a new connection is told how many slots are
+// in use before naming.
+func TestShowCapacity(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) { s.ShowCapacity = true })
+	alice := joinClient(t, addr, "Alice")
+	joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+
+	c := dialClient(t, addr)
+	c.expect("[INFO]: 2/10 slots in use")
+}
+
+// TestWhoami tests that /whoami reports the current name privately.
+func TestWhoami(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	alice := joinClient(t, addr, "Alice")
+
+	alice.send("/name Alicia")
+	admin.expect("Alice changed their name to Alicia")
+	alice.send("/whoami")
+	line := alice.expect("You are Alicia, joined ")
+	if !strings.Contains(line, "admin: no, room: #general.") {
+		t.Errorf("Unexpected /whoami reply %q", line)
+	}
+	admin.expectNone("You are")
+
+	admin.send("/whoami")
+	admin.expect("admin: yes, room: #general.")
+}
+
+// TestServerAnnounce tests that Server.Announce has written the message to every
+// client by the time it returns.
+func TestServerAnnounce(t *testing.T) {
+	server, addr := startTestServer(t)
+	clients := []*testClient{joinClient(t, addr, "Alice"), joinClient(t, addr, "Bob"), joinClient(t, addr, "Carol")}
+	clients[0].expect("Carol joined the chat")
+
+	server.Announce("server restarting, reconnect in 30s")
+	server.ClientsLock.Lock()
+	for _, client := range server.Clients {
+		if delivered := client.delivered.Load(); delivered != int64(client.queued) {
+			t.Errorf("%s: %d of %d lines delivered when Announce returned", client.Username, delivered, client.queued)
+		}
+	}
+	server.ClientsLock.Unlock()
+
+	for _, c := range clients {
+		c.expect("[INFO]: server restarting, reconnect in 30s")
+	}
+}
+
+// TestEOL tests that /eol crlf changes the line endings delivered to that
+// client only.
+func TestEOL(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	carol := joinClient(t, addr, "Carol")
+	alice.expect("Carol joined the chat")
+	bob.expect("Carol joined the chat")
+
+	alice.send("/eol dos")
+	alice.expect("Usage: /eol crlf|lf")
+	alice.send("/eol crlf")
+	if line := alice.expect("Line endings set to crlf."); !strings.HasSuffix(line, ".\r\n") {
+		t.Errorf("Alice got the /eol reply as %q, want a CRLF ending", line)
+	}
+	alice.send("/whoami")
+	if line := alice.expect("You are Alice"); !strings.HasSuffix(line, ".\r\n") {
+		t.Errorf("Alice got the /whoami reply as %q, want a CRLF ending", line)
+	}
+
+	carol.send("hello")
+	if line := alice.expect("[Carol]: hello"); !strings.HasSuffix(line, "hello\r\n") {
+		t.Errorf("Alice got %q, want a CRLF ending", line)
+	}
+	if line := bob.expect("[Carol]: hello"); !strings.HasSuffix(line, "hello\n") || strings.HasSuffix(line, "\r\n") {
+		t.Errorf("Bob got %q, want an LF ending", line)
+	}
+
+	alice.send("/eol lf")
+	if line := alice.expect("Line endings set to lf."); strings.HasSuffix(line, "\r\n") {
+		t.Errorf("Alice got the /eol reply as %q after /eol lf", line)
+	}
+	carol.send("again")
+	if line := alice.expect("[Carol]: again"); strings.HasSuffix(line, "\r\n") {
+		t.Errorf("Alice got %q after /eol lf", line)
+	}
+}
+
+// TestStatus tests that /status reflects lurking, lockdown, slow mode and
+// ignores.
+func TestStatus(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	alice := joinClient(t, addr, "Alice")
+
+	alice.send("/status")
+	alice.expect("Room: #general, lurking: no, chat locked: no, slow mode wait: 0s, ignoring: 0.")
+
+	admin.send("/slowmode 30")
+	alice.expect("slow mode set to 30s")
+	alice.send("hi")
+	admin.expect("[Alice]: hi")
+	admin.send("/lockdown on")
+	alice.expect("chat locked")
+	alice.send("/ignore Admin")
+	alice.expect("Admin")
+	alice.send("/join dev")
+	alice.expect("You joined #dev.")
+	alice.send("/lurk")
+	alice.expect("Read-only mode on.")
+
+	alice.send("/status")
+	alice.expect("Room: #dev, lurking: yes, chat locked: yes, slow mode wait: 30s, ignoring: 1.")
+	admin.send("/status")
+	admin.expect("chat locked: no")
+}
+
+// TestIdleWarning tests that idle clients are warned before being
+// disconnected.
+func TestIdleWarning(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.IdleTimeout = 600 * time.Millisecond
+		s.IdleWarning = 300 * time.Millisecond
+	})
+	alice := joinClient(t, addr, "Alice")
+
+	alice.expect("[INFO]: you will be disconnected for inactivity in 300ms")
+	alice.expect("[INFO]: disconnected: idle timeout")
+	alice.expectClosed()
+}
+
+// TestIdleWarningCancelled tests that activity after the warning keeps the
+// client connected.
+func TestIdleWarningCancelled(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.IdleTimeout = 800 * time.Millisecond
+		s.IdleWarning = 400 * time.Millisecond
+	})
+	alice := joinClient(t, addr, "Alice")
+
+	alice.expect("you will be disconnected for inactivity")
+	alice.send("/whoami")
+	alice.expect("You are Alice")
+	alice.expectNone("disconnected: idle timeout")
+	alice.expect("you will be disconnected for inactivity")
+}
+
+// TestLurk tests that a lurking client receives messages but can't send
+// until it runs /unlurk.
+func TestLurk(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	bob.send("/lurk")
+	bob.expect("Read-only mode on")
+	bob.send("hello from the shadows")
+	bob.expect("You are in read-only mode.")
+	bob.send("/msg Alice psst")
+	bob.expect("You are in read-only mode.")
+	alice.expectNone("shadows")
+
+	alice.send("anyone there?")
+	bob.expect("anyone there?")
+
+	bob.send("/unlurk")
+	bob.expect("Read-only mode off.")
+	bob.send("I'm here")
+	alice.expect("I'm here")
+}
+
+// TestTruncateUTF8 tests that truncation never splits a multi-byte rune.
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"héllo", 2, "h"}, // é is 2 bytes
+		{"€€€", 7, "€€"},  // € is 3 bytes
+		{"日本語", 6, "日本"},  // cut at a boundary
+		{"🙂🙂", 5, "🙂"},    // 4-byte runes
+		{"🙂", 3, ""},
+	}
+	for _, tt := range tests {
+		got := truncateUTF8(tt.in, tt.max)
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+	}
+}
+
+// TestMaxMsgLen tests that over-length messages are truncated before being
+// broadcast.
+func TestMaxMsgLen(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.MaxMsgLen = 8
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("héhéhéhé")
+	alice.expect("Message truncated to 8 bytes.")
+	if line := bob.expect("héh"); !strings.HasSuffix(line, "]: héhéh\n") {
+		t.Errorf("Got %q, want the message cut to héhéh", line)
+	}
+}
+
+// TestMissedNotice tests that a returning user is told how many messages
+// were posted while they were gone, and that /resume reports the same.
+func TestMissedNotice(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.MissedNotice = true
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.send("before")
+	bob.expect("before")
+	bob.send("/exit")
+	alice.expect("Bob left the chat")
+
+	alice.send("one")
+	alice.send("two")
+	alice.send("/resume 1")
+	alice.expect("[INFO]: you missed 2 messages")
+
+	bob = dialClient(t, addr)
+	bob.send("Bob")
+	bob.expect("[INFO]: you missed 2 messages")
+
+	carol := dialClient(t, addr)
+	carol.send("Carol")
+	carol.expect("Carol joined the chat")
+	carol.expectNone("you missed")
+}
+
+// TestTimestampsOff tests that a client can hide message timestamps for
+// itself only.
+func TestTimestampsOff(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	carol := joinClient(t, addr, "Carol")
+
+	bob.send("/timestamps off")
+	bob.expect("Timestamps off.")
+	alice.send("hello")
+	if line, want := bob.expect("hello"), "[Alice]: hello\n"; line != want {
+		t.Errorf("Bob got %q, want %q", line, want)
+	}
+	if line := carol.expect("hello"); !strings.HasPrefix(line, "[20") {
+		t.Errorf("Carol got %q, want a timestamp", line)
+	}
+
+	bob.send("/timestamps on")
+	bob.expect("Timestamps on.")
+	alice.send("again")
+	if line := bob.expect("again"); !strings.HasPrefix(line, "[20") {
+		t.Errorf("Bob got %q, want a timestamp", line)
+	}
+}
+
+// TestWriteFailureDisconnects tests that a client whose connection is reset
+// is removed and announced as gone.
+func TestWriteFailureDisconnects(t *testing.T) {
+	server, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+
+	// Stop reading and reset the connection so writes to it fail.
+	bob.conn.(*net.TCPConn).SetLinger(0)
+	bob.conn.Close()
+	for i := 0; i < 5; i++ {
+		alice.send(fmt.Sprintf("message %d", i))
+	}
+	alice.expect("Bob left the chat")
+
+	server.ClientsLock.Lock()
+	defer server.ClientsLock.Unlock()
+	if _, ok := server.Clients["Bob"]; ok {
+		t.Error("Bob is still in the client list")
+	}
+}
+
+// TestKickAll tests that /kickall disconnects every client but the admin.
+func TestKickAll(t *testing.T) {
+	server, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	users := []*testClient{
+		joinClient(t, addr, "Alice"),
+		joinClient(t, addr, "Bob"),
+		joinClient(t, addr, "Carol"),
+	}
+
+	users[0].send("/kickall")
+	users[0].expect("Only admins can kick everyone.")
+
+	admin.send("/kickall maintenance")
+	admin.expect("Kicked 3 clients.")
+	for _, user := range users {
+		user.expect("[INFO]: disconnected: maintenance")
+		user.expectClosed()
+	}
+
+	server.ClientsLock.Lock()
+	defer server.ClientsLock.Unlock()
+	if len(server.Clients) != 1 || server.Clients["Admin"] == nil {
+		t.Errorf("Clients left: %v", server.Clients)
+	}
+}
+
+// TestCommandAtNamePrompt tests that a command typed at the name prompt is
+// refused instead of becoming a username.
+func TestCommandAtNamePrompt(t *testing.T) {
+	server, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+
+	c := dialClient(t, addr)
+	c.send("/exit")
+	c.expect("Please enter a name, not a command.")
+	alice.expectNone("/exit joined")
+	c.send("Bob")
+	c.expect("Bob joined the chat")
+
+	server.ClientsLock.Lock()
+	defer server.ClientsLock.Unlock()
+	if _, ok := server.Clients["/exit"]; ok {
+		t.Error(`"/exit" was registered as a username`)
+	}
+}
+
+// TestStaleNameTakeover tests that a reconnecting client can take over its
+// name from an entry whose connection has died unnoticed.
+func TestStaleNameTakeover(t *testing.T) {
+	server, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+
+	// A client whose peer vanished: writes to it fail.
+	stale, peer := net.Pipe()
+	peer.Close()
+	server.ClientsLock.Lock()
+	ghost := &Client{Conn: stale, Username: "Bob", Out: make(chan string, 1), Ignored: make(map[string]bool), Room: DefaultRoom}
+	server.Clients["Bob"] = ghost
+	server.folded[foldName("Bob")] = ghost
+	server.ClientsLock.Unlock()
+
+	bob := dialClient(t, addr)
+	bob.send("Bob")
+	bob.expect("Bob joined the chat")
+	alice.expect("Bob left the chat")
+
+	// A live holder keeps its name.
+	dup := dialClient(t, addr)
+	dup.send("Alice")
+	dup.expect("Username already taken.")
+	alice.expect("someone tried to join with your name")
+}
+
+// endless is a reader that never ends a line.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
+
+// TestReadBoundedLine tests that an endless line is refused after reading
+// little more than the limit.
+func TestReadBoundedLine(t *testing.T) {
+	if _, err := readBoundedLine(bufio.NewReaderSize(endless{}, 64), 16); err != errNameTooLong {
+		t.Fatalf("Got error %v, want errNameTooLong", err)
+	}
+	line, err := readBoundedLine(bufio.NewReaderSize(strings.NewReader("Alice\r\nrest"), 64), 16)
+	if err != nil || line != "Alice" {
+		t.Errorf("Got %q, %v; want \"Alice\", nil", line, err)
+	}
+}
+
+// TestNameTooLong tests that an oversized name at the prompt gets the
+// client disconnected.
+func TestNameTooLong(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.MaxNameLen = 16
+	})
+	c := dialClient(t, addr)
+	go c.conn.Write([]byte(strings.Repeat("x", 1<<20) + "\n"))
+	c.expect("Name too long.")
+	c.expect("disconnected: name too long")
+	c.expectClosed()
+
+	alice := dialClient(t, addr)
+	alice.send(strings.Repeat("a", 16))
+	alice.expect(strings.Repeat("a", 16) + " joined the chat")
+	alice.send("/name " + strings.Repeat("b", 17))
+	alice.expect("Name too long.")
+}
+
+// TestNameLenRunes tests that with NameLenRunes multi-byte names are
+// measured in code points, while by default they are measured in bytes.
+func TestNameLenRunes(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) { s.MaxNameLen = 4 })
+	c := dialClient(t, addr)
+	c.send("José") // 5 bytes
+	c.expect("Name too long.")
+	alice := joinClient(t, addr, "Ana")
+	alice.send("/name 🙂🙂") // 8 bytes
+	alice.expect("Name too long.")
+
+	_, addr = startTestServer(t, func(s *Server) {
+		s.MaxNameLen = 4
+		s.NameLenRunes = true
+	})
+	jose := joinClient(t, addr, "José")
+	jose.send("/name 🙂🙂")
+	jose.expect("José changed their name to 🙂🙂")
+	jose.send("/name 🙂🙂🙂🙂🙂")
+	jose.expect("Name too long.")
+	c = dialClient(t, addr)
+	c.send("Josés")
+	c.expect("Name too long.")
+}
+
+// TestConfirm tests that -confirm sends authors a receipt carrying their
+// message's sequence number.
+func TestConfirm(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Confirm = true
+		s.Format = HumanFormatter{ShowSeq: true}
+	})
+	alice := joinClient(t, addr, "Alice")
+	alice.send("first")
+	alice.expect("[ack #1]")
+	alice.send("second")
+	alice.expect("[ack #2]")
+
+	_, addr = startTestServer(t, func(s *Server) {
+		s.Confirm = true
+	})
+	bob := joinClient(t, addr, "Bob")
+	bob.send("hello")
+	if line := bob.next(); line != "✓\n" {
+		t.Errorf("Got %q, want a bare receipt", line)
+	}
+}
+
+// TestSlowClientEvicted tests that a client that never reads is
+// disconnected once its messages keep being dropped.
+func TestSlowClientEvicted(t *testing.T) {
+	server, addr := startTestServer(t, func(s *Server) {
+		s.MaxDrops = 5
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+
+	// Bob stops reading while Alice floods the chat.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		line := strings.Repeat("x", 900) + " %d\n"
+		for i := 0; i < 50000; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := fmt.Fprintf(alice.conn, line, i); err != nil {
+				return
+			}
+		}
+	}()
+	alice.expect("Bob left the chat")
+
+	server.ClientsLock.Lock()
+	_, ok := server.Clients["Bob"]
+	server.ClientsLock.Unlock()
+	if ok {
+		t.Error("Bob is still in the client list")
+	}
+
+	// Whatever was buffered for Bob, his connection ends.
+	bob.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.Copy(io.Discard, bob.conn); err != nil {
+		t.Errorf("Bob's connection was not closed: %v", err)
+	}
+}
+
+// TestVersion tests that /version is answered to the requester only.
+func TestVersion(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("/version")
+	line := alice.expect("net-cat ")
+	if !strings.Contains(line, version()) || !strings.Contains(line, "(tcp, human output)") {
+		t.Errorf("Got %q, want the version and protocol", line)
+	}
+	bob.expectNone("net-cat ")
+}
+
+// emptyConn is a connection whose first empty reads return (0, nil), after
+// which it reports EOF.
+type emptyConn struct {
+	net.Conn
+	empty int
+	reads int
+}
+
+func (c *emptyConn) Read(p []byte) (int, error) {
+	c.reads++
+	if c.reads <= c.empty {
+		return 0, nil
+	}
+	return 0, io.EOF
+}
+
+// TestEmptyReads tests that zero-byte reads are retried rather than spun on
+// and that a connection that never makes progress is given up.
+func TestEmptyReads(t *testing.T) {
+	conn := &emptyConn{empty: 3}
+	if _, err := readLine(bufio.NewReader(emptyReadGuard{conn})); err != io.EOF {
+		t.Errorf("Got error %v, want EOF", err)
+	}
+	if conn.reads != 4 {
+		t.Errorf("Got %d reads, want 4", conn.reads)
+	}
+
+	conn = &emptyConn{empty: 1000}
+	if _, err := readLine(bufio.NewReader(emptyReadGuard{conn})); err != io.ErrNoProgress {
+		t.Errorf("Got error %v, want io.ErrNoProgress", err)
+	}
+	if conn.reads != MaxEmptyReads {
+		t.Errorf("Got %d reads, want %d", conn.reads, MaxEmptyReads)
+	}
+}
+
+// TestFeatures tests that /features reflects the server's configuration.
+func TestFeatures(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	alice.send("/features")
+	line := alice.expect("Features: ")
+	if !strings.Contains(line, " rooms ") || strings.Contains(line, "color") || strings.Contains(line, "confirm") {
+		t.Errorf("Unexpected features on a default server: %q", line)
+	}
+	alice.send("/slowmode 5")
+	alice.expect("slow mode set to 5s")
+	alice.send("/features")
+	if line := alice.expect("Features: "); !strings.Contains(line, "slowmode") {
+		t.Errorf("Expected slowmode in %q", line)
+	}
+
+	_, addr = startTestServer(t, func(s *Server) {
+		s.Colors = true
+		s.Confirm = true
+	})
+	bob := joinClient(t, addr, "Bob")
+	bob.send("/features")
+	if line := bob.expect("Features: "); !strings.Contains(line, " color ") || !strings.Contains(line, " confirm") {
+		t.Errorf("Expected color and confirm in %q", line)
+	}
+}
+
+// TestFanout tests that broadcasts rendered by workers reach everyone but
+// the sender, honoring each recipient's settings.
+func TestFanout(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Fanout = 4
+	})
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	carol := joinClient(t, addr, "Carol")
+	carol.send("/timestamps off")
+	carol.expect("Timestamps off.")
+
+	alice.send("hello")
+	if line := bob.expect("hello"); !strings.HasPrefix(line, "[20") {
+		t.Errorf("Bob should see a timestamp, got %q", line)
+	}
+	if line := carol.expect("hello"); line != "[Alice]: hello\n" {
+		t.Errorf("Carol got %q, want no timestamp", line)
+	}
+	alice.expectNone("hello")
+}
+
+// benchmarkBroadcast measures broadcasting a signed line-protocol message
+// to 1000 clients with the given number of fan-out workers.
+func benchmarkBroadcast(b *testing.B, fanout int) {
+	server := newTestServer(b, TCP, "0")
+	server.Format = LineFormatter{Secret: []byte("secret")}
+	server.Fanout = fanout
+	defer func() {
+		// The clients have no connections to disconnect.
+		server.Clients = make(map[string]*Client)
+		server.Shutdown()
+	}()
+
+	clients := make([]*Client, 1000)
+	for i := range clients {
+		name := fmt.Sprintf("user%d", i)
+		clients[i] = &Client{Username: name, Out: make(chan string, 1), Ignored: make(map[string]bool), Room: DefaultRoom}
+		server.Clients[name] = clients[i]
+		server.folded[foldName(name)] = clients[i]
+	}
+
+	msg := Message{Timestamp: time.Now(), Client: "sender", Content: strings.Repeat("x", 200)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server.broadcastMessage(msg, "sender")
+
+		b.StopTimer()
+		for _, client := range clients {
+			<-client.Out
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkBroadcastSerial(b *testing.B)  { benchmarkBroadcast(b, 0) }
+func BenchmarkBroadcastFanout8(b *testing.B) { benchmarkBroadcast(b, 8) }
+
+// TestHalfClose tests that with AllowHalfClose a client that closed its
+// sending side keeps receiving broadcasts.
+func TestHalfClose(t *testing.T) {
+	server, addr := startTestServer(t, func(s *Server) {
+		s.AllowHalfClose = true
+	})
+	alice := joinClient(t, addr, "Alice")
+	reader := joinClient(t, addr, "Reader")
+	alice.expect("Reader joined the chat")
+
+	reader.send("last words")
+	alice.expect("last words")
+	if err := reader.conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	alice.expectNone("Reader left the chat")
+
+	alice.send("still there?")
+	reader.expect("still there?")
+
+	server.ClientsLock.Lock()
+	_, ok := server.Clients["Reader"]
+	server.ClientsLock.Unlock()
+	if !ok {
+		t.Error("Reader was removed after closing its sending side")
+	}
+}
+
+// TestBackspaces tests that backspace and DEL erase the character before
+// them, both at the name prompt and in messages.
+func TestBackspaces(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"abc\x7f\x7fX", "aX"},
+		{"héh\b\bY", "hY"},
+		{"\x7f\x7fok", "ok"},
+		{"plain", "plain"},
+	}
+	for _, tt := range tests {
+		line, err := readLine(bufio.NewReader(strings.NewReader(tt.in + "\n")))
+		if err != nil || line != tt.want {
+			t.Errorf("readLine(%q) = %q, %v; want %q", tt.in, line, err, tt.want)
+		}
+	}
+
+	_, addr := startTestServer(t)
+	alice := dialClient(t, addr)
+	alice.send("Alixx\x7f\x7fce")
+	alice.expect("Alice joined the chat")
+	bob := joinClient(t, addr, "Bob")
+	alice.send("abc\x7f\x7fX")
+	if line := bob.expect("[Alice]"); !strings.HasSuffix(line, "[Alice]: aX\n") {
+		t.Errorf("Got %q, want the edited line aX", line)
+	}
+}
+
+// TestLockdown tests that /lockdown stops non-admins from posting until it
+// is lifted, while admins can still post.
+func TestLockdown(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+
+	bob.send("/lockdown on")
+	bob.expect("Only admins can lock the chat.")
+
+	bob.send("before the lock")
+	admin.expect("before the lock")
+	admin.send("/lockdown on")
+	bob.expect("[INFO]: chat locked")
+	bob.send("let me talk")
+	bob.expect("Chat is locked.")
+	admin.expectNone("let me talk")
+
+	// Commands that show text Bob wrote to the room are locked too.
+	for _, command := range []string{"/edit SPAM", "/topic SPAM", `/poll "SPAM" a b`, "/shout spam"} {
+		bob.send(command)
+		bob.expect("Chat is locked.")
+		admin.expectNone("SPAM")
+	}
+	admin.send("announcement from the admin")
+	bob.expect("announcement from the admin")
+
+	admin.send("/lockdown off")
+	bob.expect("[INFO]: chat unlocked")
+	bob.send("thanks")
+	admin.expect("thanks")
+}
+
+// TestShout tests that /shout uppercases the message, is kept in history,
+// and is rate-limited more tightly than ordinary messages.
+func TestShout(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+
+	alice.send("/shout")
+	alice.expect("Usage: /shout <text>")
+	alice.send("/shout hello there")
+	if line := bob.expect("[SHOUT]"); !strings.HasSuffix(line, "[SHOUT][Alice]: HELLO THERE\n") {
+		t.Errorf("Got %q, want an uppercased shout", line)
+	}
+
+	alice.send("/shout again")
+	alice.expect("You can shout again in 60s.")
+	bob.expectNone("AGAIN")
+	alice.send("normal message")
+	bob.expect("[Alice]: normal message")
+
+	// The shout is replayed to newcomers.
+	carol := dialClient(t, addr)
+	carol.send("Carol")
+	carol.expect("[SHOUT][Alice]: HELLO THERE")
+}
+
+// TestDisconnectBeforeNaming tests that a connection dropped at the name
+// prompt is only logged, while a client that joined is announced as gone.
+func TestDisconnectBeforeNaming(t *testing.T) {
+	server, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+
+	anon := dialClient(t, addr)
+	anon.conn.Close()
+	alice.expectNone("left the chat")
+	if !auditHas(server, "closed before naming") {
+		t.Error("A dropped name prompt was not logged")
+	}
+
+	bob := joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+	bob.conn.Close()
+	alice.expect("Bob left the chat")
+	if !auditHas(server, "Client Bob left (connection closed).") {
+		t.Error("Bob's leave was not logged")
+	}
+}
+
+// auditHas reports whether a recent audit event contains text.
+func auditHas(server *Server, text string) bool {
+	for _, event := range server.recentAudit(MaxAuditEvents) {
+		if strings.Contains(event.Text, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestNoForgedLines tests that line breaks inside a message can't start a
+// separate line on the recipient's side.
+func TestNoForgedLines(t *testing.T) {
+	server, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+
+	alice.send("hi\r[INFO]: fake")
+	if line := bob.expect("[Alice]: "); !strings.HasSuffix(line, "[Alice]: hi [INFO]: fake\n") {
+		t.Errorf("Got %q, want the carriage return replaced", line)
+	}
+
+	server.broadcastMessage(Message{Client: "Alice", Content: "hi\n[INFO]: fake", Timestamp: time.Now()}, "Alice")
+	if line := bob.next(); !strings.HasSuffix(line, "[Alice]: hi [INFO]: fake\n") {
+		t.Errorf("Got %q, want the message on one line", line)
+	}
+	bob.expectNone("fake")
+}
+
+// TestGoroutineCap tests that connections past MaxGoroutines client
+// goroutines are turned away even when MaxClients has room.
+func TestGoroutineCap(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) { s.MaxGoroutines = 2 })
+	joinClient(t, addr, "Alice") // its reader and its sender
+
+	late := dialClient(t, addr)
+	late.expect("disconnected: server busy")
+	late.expectClosed()
+}
+
+// TestNoGoroutineLeak tests that clients connecting and leaving in quick
+// succession don't leave goroutines behind.
+func TestNoGoroutineLeak(t *testing.T) {
+	server, addr := startTestServer(t)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		client := joinClient(t, addr, fmt.Sprintf("User%d", i))
+		client.conn.Close()
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for server.goroutines.Load() > 0 || runtime.NumGoroutine() > before+5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d client goroutines and %d in all still running, started with %d",
+				server.goroutines.Load(), runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestGuestNames tests that with AllowGuest an empty name joins under a
+// unique Guest-NNNN name, and that without it the name is still refused.
+func TestGuestNames(t *testing.T) {
+	_, addr := startTestServer(t, func(s *Server) { s.AllowGuest = true })
+	alice := joinClient(t, addr, "Alice")
+
+	var names []string
+	for i := 0; i < 2; i++ {
+		guest := dialClient(t, addr)
+		guest.send("")
+		line := guest.expect("You joined as Guest-")
+		_, name, _ := strings.Cut(strings.TrimSuffix(line, ".\n"), "You joined as ")
+		alice.expect(fmt.Sprintf("[INFO]: %s joined the chat", name))
+		names = append(names, name)
+	}
+	if names[0] == names[1] {
+		t.Errorf("Both guests were named %s", names[0])
+	}
+
+	_, addr = startTestServer(t)
+	c := dialClient(t, addr)
+	c.send("")
+	c.expect("Invalid username.")
+}
+
+// TestUnknownCommand tests that a mistyped command is refused privately
+// rather than sent to the room or stored.
+func TestUnknownCommand(t *testing.T) {
+	server, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+
+	alice.send("/mgs Bob hi")
+	alice.expect("Unknown command: /mgs. Type /help.")
+	bob.expectNone("/mgs")
+	alice.send("/help")
+	if line := alice.next(); !strings.HasPrefix(line, "Commands: ") || !strings.Contains(line, " /msg ") {
+		t.Errorf("Got %q, want the command list", line)
+	}
+
+	server.MsgLock.Lock()
+	stored := len(server.Messages)
+	server.MsgLock.Unlock()
+	if stored != 0 {
+		t.Errorf("Stored %d messages, want none", stored)
+	}
+}
+
+// TestSlashEscape tests that a doubled slash sends a message starting with
+// a single one.
+func TestSlashEscape(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+
+	alice.send("//shrug is not a command")
+	if line := bob.expect("[Alice]"); !strings.HasSuffix(line, "[Alice]: /shrug is not a command\n") {
+		t.Errorf("Got %q, want the message with one leading slash", line)
+	}
+}
+
+// TestShutdownDuringBroadcasts tests that Shutdown is safe while messages
+// are being broadcast, through both the serial and fan-out paths: no send
+// may reach a closed Out channel. Run with -race.
+func TestShutdownDuringBroadcasts(t *testing.T) {
+	for _, fanout := range []int{0, 4} {
+		server, addr := startTestServer(t, func(s *Server) {
+			s.Fanout = fanout
+		})
+		for i := 0; i < 10; i++ {
+			joinClient(t, addr, fmt.Sprintf("user%d", i))
+		}
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					msg := Message{Timestamp: time.Now(), Client: "bot", Content: fmt.Sprintf("%d-%d", w, i), Room: DefaultRoom}
+					server.broadcastMessage(msg, "bot")
+					server.broadcast(server.Format.Info("tick"), "")
+				}
+			}(w)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		server.Shutdown()
+		time.Sleep(20 * time.Millisecond)
+		close(stop)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import "io"
+
+// Telnet command bytes (RFC 854).
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+// States of a telnetFilter between reads.
+const (
+	telnetData   = iota
+	telnetCmd    // after IAC
+	telnetOption // after IAC WILL, WONT, DO or DONT
+	telnetSub    // inside IAC SB ... IAC SE
+	telnetSubIAC // after IAC inside a subnegotiation
+)
+
+// telnetFilter strips the option negotiation telnet clients send when they
+// connect, so the IAC sequences don't end up in a username or message.
+// An escaped IAC IAC is kept as a single 0xFF byte.
+type telnetFilter struct {
+	r     io.Reader
+	state int
+}
+
+func (f *telnetFilter) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		kept := f.filter(p[:n])
+		// A read of nothing but negotiation is retried rather than
+		// returned empty, which the caller would count as no progress.
+		if kept > 0 || n == 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// filter removes telnet commands from b in place and returns how many
+// bytes are left.
+func (f *telnetFilter) filter(b []byte) int {
+	kept := 0
+	for _, c := range b {
+		switch f.state {
+		case telnetData:
+			if c == telnetIAC {
+				f.state = telnetCmd
+				continue
+			}
+			b[kept] = c
+			kept++
+		case telnetCmd:
+			switch {
+			case c == telnetIAC:
+				b[kept] = c
+				kept++
+				f.state = telnetData
+			case c == telnetSB:
+				f.state = telnetSub
+			case c >= telnetWILL && c <= telnetDONT:
+				f.state = telnetOption
+			default:
+				f.state = telnetData
+			}
+		case telnetOption:
+			f.state = telnetData
+		case telnetSub:
+			if c == telnetIAC {
+				f.state = telnetSubIAC
+			}
+		case telnetSubIAC:
+			if c == telnetSE {
+				f.state = telnetData
+			} else {
+				f.state = telnetSub
+			}
+		}
+	}
+	return kept
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// TestTelnetFilter tests that negotiation, subnegotiation and plain
+// commands are removed, including when split across reads, and that an
+// escaped IAC is kept.
+func TestTelnetFilter(t *testing.T) {
+	input := "\xff\xfb\x1f\xff\xfd\x03Al\xff\xfa\x18\x00xterm\xff\xf0ice\xff\xf1\xff\xff\n"
+	for name, r := range map[string]io.Reader{
+		"whole":    strings.NewReader(input),
+		"bytewise": iotest.OneByteReader(strings.NewReader(input)),
+	} {
+		got, err := io.ReadAll(&telnetFilter{r: r})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(got) != "Alice\xff\n" {
+			t.Errorf("%s: got %q, want %q", name, got, "Alice\xff\n")
+		}
+	}
+}
+
+// TestTelnetNegotiationInName tests that a telnet client's negotiation
+// sent before its name doesn't become part of it.
+func TestTelnetNegotiationInName(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+
+	c := dialClient(t, addr)
+	c.conn.Write([]byte("\xff\xfb\x1f\xff\xfb\x20\xff\xfd\x01Alice\r\n"))
+	admin.expect("[INFO]: Alice joined the chat\n")
+	c.send("hello")
+	admin.expect("[Alice]: hello")
+}
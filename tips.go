@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultTipInterval is how often a tip is broadcast with -tips.
+const DefaultTipInterval = 5 * time.Minute
+
+// ReadTips reads one tip per line from path, skipping blank lines and lines
+// starting with '#'.
+func ReadTips(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var tips []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tips = append(tips, line)
+		}
+	}
+	return tips, scanner.Err()
+}
+
+// rotateTips broadcasts the next of s.Tips every interval, starting over
+// after the last one, until the server shuts down.
+func (s *Server) rotateTips(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	next := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.broadcast(s.Format.Info("Tip: "+s.Tips[next]), "INFO")
+		next = (next + 1) % len(s.Tips)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTipRotation tests that tips are broadcast in file order and start
+// over after the last one.
+func TestTipRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tips.txt")
+	if err := os.WriteFile(path, []byte("# rules\nBe kind.\n\nNo spam.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tips, err := ReadTips(path)
+	if err != nil {
+		t.Fatalf("ReadTips: %v", err)
+	}
+
+	_, addr := startTestServer(t, func(s *Server) {
+		s.Tips = tips
+		s.TipInterval = 100 * time.Millisecond
+	})
+	alice := joinClient(t, addr, "Alice")
+
+	// Ticks may have passed before Alice joined, so find where the cycle is.
+	first := alice.expect("[INFO]: Tip: ")
+	want := map[string]string{
+		"[INFO]: Tip: Be kind.\n": "[INFO]: Tip: No spam.\n",
+		"[INFO]: Tip: No spam.\n": "[INFO]: Tip: Be kind.\n",
+	}
+	line := first
+	for i := 0; i < 3; i++ {
+		next := alice.expect("[INFO]: Tip: ")
+		if next != want[line] {
+			t.Fatalf("Tip %q followed %q, want %q", next, line, want[line])
+		}
+		line = next
+	}
+}
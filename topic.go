@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxTopicHistory is how many past topics /topichistory can show.
+const MaxTopicHistory = 20
+
+// MaxTopicLen is the longest topic in bytes; longer ones are truncated.
+const MaxTopicLen = 200
+
+// Topic is a chat topic and who set it.
+type Topic struct {
+	Text  string
+	SetBy string
+	Time  time.Time
+}
+
+// currentTopic returns the latest topic, if one was set.
+func (s *Server) currentTopic() (Topic, bool) {
+	s.TopicLock.Lock()
+	defer s.TopicLock.Unlock()
+	if len(s.topics) == 0 {
+		return Topic{}, false
+	}
+	return s.topics[len(s.topics)-1], true
+}
+
+// topic handles /topic [text], showing the topic or setting a new one.
+func (s *Server) topic(client *Client, text string) {
+	if text == "" {
+		if current, ok := s.currentTopic(); ok {
+			client.Conn.Write([]byte(s.Format.Info(fmt.Sprintf("topic: %s (set by %s)", current.Text, current.SetBy))))
+		} else {
+			s.reply(client.Conn, "No topic set.\n")
+		}
+		return
+	}
+	if client.ReadOnly {
+		s.reply(client.Conn, "You are in read-only mode.\n")
+		return
+	}
+	if s.lockedOut(client) {
+		return
+	}
+	text = truncateUTF8(oneLine(text), MaxTopicLen)
+
+	s.TopicLock.Lock()
+	s.topics = append(s.topics, Topic{Text: text, SetBy: client.Username, Time: time.Now()})
+	if len(s.topics) > MaxTopicHistory {
+		s.topics = s.topics[len(s.topics)-MaxTopicHistory:]
+	}
+	s.TopicLock.Unlock()
+
+	s.broadcast(s.Format.Info(fmt.Sprintf("%s changed the topic to: %s", client.Username, text)), "")
+	s.logActivity(fmt.Sprintf("Client %s set the topic to %q.", client.Username, text))
+}
+
+// sendTopic tells a new client the current topic, if any.
+func (s *Server) sendTopic(client *Client) {
+	if current, ok := s.currentTopic(); ok {
+		client.Conn.Write([]byte(s.Format.Info(fmt.Sprintf("topic: %s (set by %s)", current.Text, current.SetBy))))
+	}
+}
+
+// topicHistory handles /topichistory, listing past topics newest first.
+func (s *Server) topicHistory(client *Client) {
+	s.TopicLock.Lock()
+	topics := append([]Topic(nil), s.topics...)
+	s.TopicLock.Unlock()
+
+	var b strings.Builder
+	for i := len(topics) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "[TOPIC]: [%s] %s: %s\n", topics[i].Time.In(s.Location).Format(TimeFormat), topics[i].SetBy, topics[i].Text)
+	}
+	if b.Len() == 0 {
+		b.WriteString("No topic set.\n")
+	}
+	s.reply(client.Conn, b.String())
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestTopicHistory tests that /topichistory lists past topics newest first
+// with who set them, and that new clients are told the current topic.
+func TestTopicHistory(t *testing.T) {
+	_, addr := startTestServer(t)
+	alice := joinClient(t, addr, "Alice")
+	bob := joinClient(t, addr, "Bob")
+	alice.expect("Bob joined the chat")
+
+	bob.send("/topichistory")
+	bob.expect("No topic set.")
+
+	alice.send("/topic release planning")
+	bob.expect("Alice changed the topic to: release planning")
+	bob.send("/topic bug triage")
+	alice.expect("Bob changed the topic to: bug triage")
+
+	alice.send("/topichistory")
+	want := []string{"Bob: bug triage", "Alice: release planning"}
+	for _, w := range want {
+		line := strings.TrimSuffix(alice.next(), "\n")
+		if !strings.HasPrefix(line, "[TOPIC]: ") || !strings.HasSuffix(line, w) {
+			t.Fatalf("Got %q, want a topic line ending in %q", line, w)
+		}
+	}
+
+	carol := dialClient(t, addr)
+	carol.send("Carol")
+	carol.expect("topic: bug triage (set by Bob)")
+}
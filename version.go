@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// Version is the server version. Release builds set it with
+// -ldflags "-X main.Version=v1.2.3"; otherwise the module version recorded
+// in the binary's build info is used.
+var Version string
+
+// version returns the version reported by /version.
+func version() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// sendVersion handles /version, telling the client which server version
+// and wire protocol it is talking to.
+func (s *Server) sendVersion(client *Client) {
+	output := "human"
+	if _, ok := s.Format.(LineFormatter); ok {
+		output = "line"
+	}
+	if s.Frames {
+		output += ", framed"
+	}
+	s.reply(client.Conn, fmt.Sprintf("net-cat %s (%s, %s output)\n", version(), s.Protocol, output))
+}
+
+// features lists the capabilities enabled in the server's configuration,
+// for /features.
+func (s *Server) features() []string {
+	s.ModeLock.Lock()
+	slowMode := s.SlowMode > 0
+	s.ModeLock.Unlock()
+	_, open := s.Auth.(NoAuth)
+
+	features := []string{"rooms", "pm", "reply", "edit", "files"}
+	optional := []struct {
+		name    string
+		enabled bool
+	}{
+		{"seq", s.showSeq()},
+		{"color", s.Colors},
+		{"confirm", s.Confirm},
+		{"history", s.HistoryFile != ""},
+		{"auth", !open},
+		{"frames", s.Frames},
+		{"signed", s.signed()},
+		{"slowmode", slowMode},
+		{"queue", s.QueueSize > 0},
+	}
+	for _, f := range optional {
+		if f.enabled {
+			features = append(features, f.name)
+		}
+	}
+	return features
+}
+
+// showSeq reports whether messages are shown with their sequence numbers.
+func (s *Server) showSeq() bool {
+	f, ok := s.Format.(HumanFormatter)
+	return ok && f.ShowSeq
+}
+
+// signed reports whether line-protocol output carries HMAC signatures.
+func (s *Server) signed() bool {
+	f, ok := s.Format.(LineFormatter)
+	return ok && len(f.Secret) > 0
+}
+
+// sendFeatures handles /features.
+func (s *Server) sendFeatures(client *Client) {
+	s.reply(client.Conn, "Features: "+strings.Join(s.features(), " ")+"\n")
+}
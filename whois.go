@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	in, out atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+// whois handles /whois <user>. Admins see everything; other clients get an
+// error, or with WhoisRedacted a version without the remote address and
+// traffic.
+func (s *Server) whois(client *Client, target string) {
+	if target == "" {
+		s.reply(client.Conn, "Usage: /whois <user>\n")
+		return
+	}
+	if !s.isAdmin(client) && !s.WhoisRedacted {
+		s.reply(client.Conn, "Insufficient privileges.\n")
+		return
+	}
+
+	s.ClientsLock.Lock()
+	other := s.findClient(target)
+	if other == nil {
+		s.ClientsLock.Unlock()
+		s.reply(client.Conn, fmt.Sprintf("%s is not online.\n", target))
+		return
+	}
+	name, room, lurking, ignoring := other.Username, other.Room, other.ReadOnly, len(other.Ignored)
+	joined, conn := other.JoinedAt, other.Conn
+	s.ClientsLock.Unlock()
+
+	reply := fmt.Sprintf("[WHOIS]: %s joined=%s room=#%s lurking=%s ignoring=%d",
+		name, joined.In(s.Location).Format(TimeFormat), room, yesNo(lurking), ignoring)
+	if s.isAdmin(client) {
+		reply += fmt.Sprintf(" address=%s", conn.RemoteAddr())
+		if eol, ok := conn.(*eolConn); ok {
+			conn = eol.Conn
+		}
+		if counted, ok := conn.(*countingConn); ok {
+			reply += fmt.Sprintf(" bytes_in=%d bytes_out=%d", counted.in.Load(), counted.out.Load())
+		}
+	}
+	s.reply(client.Conn, reply+"\n")
+}
+
+// yesNo formats a flag for command replies.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestWhois tests that admins see a client's address and traffic while
+// other clients are refused, or get a redacted reply with -whoispublic.
+func TestWhois(t *testing.T) {
+	_, addr := startTestServer(t)
+	admin := joinClient(t, addr, "Admin")
+	bob := joinClient(t, addr, "Bob")
+	bob.send("/lurk")
+	bob.expect("Read-only mode on")
+
+	admin.send("/whois bob")
+	line := admin.expect("[WHOIS]: Bob ")
+	for _, want := range []string{"room=#general", "lurking=yes", "ignoring=0", "address=127.0.0.1:", "bytes_in=", "bytes_out="} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Admin /whois reply %q lacks %q", line, want)
+		}
+	}
+
+	bob.send("/whois Admin")
+	bob.expect("Insufficient privileges.")
+
+	_, addr = startTestServer(t, func(s *Server) {
+		s.WhoisRedacted = true
+	})
+	joinClient(t, addr, "Admin")
+	bob = joinClient(t, addr, "Bob")
+	bob.send("/whois Admin")
+	line = bob.expect("[WHOIS]: Admin ")
+	if strings.Contains(line, "127.0.0.1") || strings.Contains(line, "bytes_in") {
+		t.Errorf("Redacted /whois reply %q shows connection details", line)
+	}
+}
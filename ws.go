@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The WebSocket gateway (-ws) lets browsers join the chat. Each WebSocket
+// connection is served like a TCP one: every text message the browser
+// sends is one input line, starting with the username, and every write to
+// the client is sent as one text message.
+
+// wsGUID is the key suffix the opening handshake hashes (RFC 6455, 1.3).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWSPayload bounds the frames a client may send.
+const maxWSPayload = 1024 * 1024
+
+// WebSocket frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// serveWebSocket accepts WebSocket clients on listener until it is closed.
+func (s *Server) serveWebSocket(listener net.Listener) {
+	s.ClientsLock.Lock()
+	if s.closed {
+		s.ClientsLock.Unlock()
+		listener.Close()
+		return
+	}
+	s.wsListener = listener
+	s.ClientsLock.Unlock()
+
+	server := &http.Server{Handler: http.HandlerFunc(s.upgradeWebSocket)}
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("WebSocket gateway stopped: %v", err)
+	}
+}
+
+// upgradeWebSocket completes the opening handshake and serves the
+// connection as a chat client.
+func (s *Server) upgradeWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !headerHas(r.Header, "Connection", "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	raw, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("WebSocket hijack failed: %v", err)
+		return
+	}
+	fmt.Fprintf(raw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+
+	conn := &wsConn{Conn: raw, r: rw.Reader}
+	if s.busy(conn) {
+		return
+	}
+	if !s.track(conn) {
+		return
+	}
+	defer s.wg.Done()
+	s.goroutines.Add(1)
+	defer s.goroutines.Add(-1)
+	s.screen(conn, &countingConn{Conn: conn})
+}
+
+// wsAccept returns the Sec-WebSocket-Accept value for key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHas reports whether the comma-separated header name lists token.
+func headerHas(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a WebSocket connection seen as a stream of lines: reads return
+// the client's messages, each ended with a newline, and each write is sent
+// as one text message.
+type wsConn struct {
+	net.Conn
+	r       *bufio.Reader // holds anything read past the handshake
+	pending []byte        // message data not returned by Read yet
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsText, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame, as a courtesy, before closing the connection.
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, nil)
+	return c.Conn.Close()
+}
+
+// readFrame reads one frame, adding message data to c.pending and
+// answering control frames. A close frame ends the stream with io.EOF.
+func (c *wsConn) readFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	fin, opcode := header[0]&0x80 != 0, header[0]&0x0f
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > maxWSPayload {
+		return fmt.Errorf("WebSocket frame of %d bytes is too large", size)
+	}
+	if header[1]&0x80 == 0 {
+		return errors.New("unmasked WebSocket frame from client")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	switch opcode {
+	case wsText, wsBinary, wsContinuation:
+		c.pending = append(c.pending, payload...)
+		if fin && !bytes.HasSuffix(c.pending, []byte("\n")) {
+			c.pending = append(c.pending, '\n')
+		}
+	case wsPing:
+		return c.writeFrame(wsPong, payload)
+	case wsClose:
+		return io.EOF
+	}
+	return nil
+}
+
+// writeFrame sends payload as a single unmasked frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	_, err := c.Conn.Write(append(frame, payload...))
+	return err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestClient is a minimal WebSocket client for the gateway tests.
+type wsTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialWebSocket connects to the gateway at addr and completes the opening
+// handshake.
+func dialWebSocket(t *testing.T, addr string) *wsTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the gateway: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /chat HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", addr, key)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Reading the handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Handshake status %s, want 101", resp.Status)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept is %q", got)
+	}
+	return &wsTestClient{t: t, conn: conn, reader: reader}
+}
+
+// send sends text as one masked text frame.
+func (c *wsTestClient) send(text string) {
+	c.t.Helper()
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | wsText, 0x80 | byte(len(text))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(text); i++ {
+		frame = append(frame, text[i]^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatalf("Failed to send %q: %v", text, err)
+	}
+}
+
+// expect reads messages until one contains want and returns it.
+func (c *wsTestClient) expect(want string) string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			c.t.Fatalf("Did not receive %q: %v", want, err)
+		}
+		size := int(header[1] & 0x7f)
+		switch size {
+		case 126:
+			var ext [2]byte
+			io.ReadFull(c.reader, ext[:])
+			size = int(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			io.ReadFull(c.reader, ext[:])
+			size = int(binary.BigEndian.Uint64(ext[:]))
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			c.t.Fatalf("Did not receive %q: %v", want, err)
+		}
+		if header[0]&0x0f == wsText && strings.Contains(string(payload), want) {
+			return string(payload)
+		}
+	}
+}
+
+// TestWebSocketGateway tests that a WebSocket client and a TCP client
+// share the chat.
+func TestWebSocketGateway(t *testing.T) {
+	server, addr := startTestServer(t)
+	wsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.serveWebSocket(wsListener)
+
+	alice := joinClient(t, addr, "Alice")
+	browser := dialWebSocket(t, wsListener.Addr().String())
+	browser.expect("Enter your name: ")
+	browser.send("Browser")
+	browser.expect("Browser joined the chat")
+	alice.expect("Browser joined the chat")
+
+	browser.send("hello from the web")
+	alice.expect("[Browser]: hello from the web")
+	alice.send("hello from tcp")
+	browser.expect("[Alice]: hello from tcp")
+}
+
+// TestWebSocketHandshakeRequired tests that plain HTTP requests to the
+// gateway are refused.
+func TestWebSocketHandshakeRequired(t *testing.T) {
+	server, _ := startTestServer(t)
+	wsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.serveWebSocket(wsListener)
+
+	resp, err := http.Get("http://" + wsListener.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Got status %s, want 400", resp.Status)
+	}
+}
+
+// TestWebSocketLogo tests that WebSocket clients get -wslogo instead of the
+// logo TCP clients see.
+func TestWebSocketLogo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ws-logo.txt")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, addr := startTestServer(t, func(s *Server) {
+		s.WSLogoFile = path
+	})
+	if err := server.LoadFiles(); err != nil {
+		t.Fatal(err)
+	}
+	wsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.serveWebSocket(wsListener)
+
+	browser := dialWebSocket(t, wsListener.Addr().String())
+	if first := browser.expect(""); first != "Enter your name: " {
+		t.Errorf("WebSocket client got %q before the prompt", first)
+	}
+	terminal := dialClient(t, addr)
+	terminal.expect("|o_o |")
+}